@@ -0,0 +1,88 @@
+package main
+
+import (
+    "context"
+    "flag"
+    "fmt"
+    "log"
+    "os"
+    "strconv"
+    "strings"
+
+    "github.com/yourname/dsproxy/pkg/auth"
+    "github.com/yourname/dsproxy/pkg/db"
+)
+
+const apiKeyUsage = `usage: dsproxy apikey <command>
+
+commands:
+  create -name NAME -scopes read,write[,admin,metrics] [-user-prefix PREFIX]
+              create a key in Postgres and print it; it is not shown again
+  revoke ID   disable a key
+  hash KEY    print the key_sha256 of KEY for API_KEYS_FILE`
+
+// runAPIKey implements the "dsproxy apikey" subcommand.
+func runAPIKey(ctx context.Context, dbURL string, args []string) {
+    if len(args) == 0 {
+        fmt.Fprintln(os.Stderr, apiKeyUsage)
+        os.Exit(2)
+    }
+    cmd, args := args[0], args[1:]
+
+    switch cmd {
+    case "create":
+        fs := flag.NewFlagSet("apikey create", flag.ExitOnError)
+        name := fs.String("name", "", "name of the key's owner")
+        scopes := fs.String("scopes", "read", "comma-separated scopes")
+        prefix := fs.String("user-prefix", "", "restrict the key to user_ids with this prefix")
+        _ = fs.Parse(args)
+        if *name == "" {
+            log.Fatal("apikey create: -name is required")
+        }
+        k := db.APIKey{Name: *name, Scopes: strings.Split(*scopes, ","), UserPrefix: *prefix}
+        if err := auth.ValidateScopes(k.Scopes); err != nil {
+            log.Fatalf("apikey create: %v", err)
+        }
+        key, err := auth.GenerateKey()
+        if err != nil {
+            log.Fatalf("apikey create: %v", err)
+        }
+        d := connectDB(ctx, dbURL)
+        defer d.Close(ctx)
+        id, err := d.CreateAPIKey(ctx, auth.HashKey(key), k)
+        if err != nil {
+            log.Fatalf("apikey create: %v", err)
+        }
+        fmt.Printf("id:  %d\nkey: %s\n", id, key)
+    case "revoke":
+        if len(args) != 1 {
+            log.Fatal("apikey revoke: expected one key id")
+        }
+        id, err := strconv.ParseInt(args[0], 10, 64)
+        if err != nil {
+            log.Fatalf("apikey revoke: invalid id %q", args[0])
+        }
+        d := connectDB(ctx, dbURL)
+        defer d.Close(ctx)
+        if err := d.RevokeAPIKey(ctx, id); err != nil {
+            log.Fatalf("apikey revoke: %v", err)
+        }
+    case "hash":
+        if len(args) != 1 {
+            log.Fatal("apikey hash: expected one key")
+        }
+        fmt.Println(auth.HashKey(args[0]))
+    default:
+        fmt.Fprintln(os.Stderr, apiKeyUsage)
+        os.Exit(2)
+    }
+}
+
+// connectDB connects and brings the schema up to date, so api_keys exists.
+func connectDB(ctx context.Context, dbURL string) *db.DB {
+    d, err := db.New(ctx, dbURL)
+    if err != nil {
+        log.Fatalf("failed connect db: %v", err)
+    }
+    return d
+}
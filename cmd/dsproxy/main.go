@@ -2,77 +2,369 @@ package main
 
 import (
     "context"
+    "fmt"
     "log"
     "net/http"
     "os"
+    "os/signal"
+    "strconv"
+    "strings"
+    "syscall"
     "time"
 
+    "github.com/yourname/dsproxy/pkg/auth"
     "github.com/yourname/dsproxy/pkg/batcher"
     "github.com/yourname/dsproxy/pkg/cache"
     "github.com/yourname/dsproxy/pkg/db"
+    "github.com/yourname/dsproxy/pkg/deadletter"
     "github.com/yourname/dsproxy/pkg/handler"
+    "github.com/yourname/dsproxy/pkg/ratelimit"
+    "github.com/yourname/dsproxy/pkg/wal"
 )
 
 func main() {
     ctx := context.Background()
-    
-    // Read individual env vars and construct DATABASE_URL
-    dbHost := os.Getenv("DB_HOST")
-    if dbHost == "" {
-        dbHost = "localhost"
-    }
-    dbPort := os.Getenv("DB_PORT")
-    if dbPort == "" {
-        dbPort = "5432"
-    }
-    dbUser := os.Getenv("DB_USER")
-    if dbUser == "" {
-        dbUser = "postgres"
-    }
-    dbPass := os.Getenv("DB_PASS")
-    if dbPass == "" {
-        dbPass = "postgres"
-    }
-    dbName := os.Getenv("DB_NAME")
-    if dbName == "" {
-        dbName = "mydb"
-    }
-    
-    dbURL := "postgres://" + dbUser + ":" + dbPass + "@" + dbHost + ":" + dbPort + "/" + dbName + "?sslmode=disable"
-    
-    redisAddr := os.Getenv("REDIS_ADDR")
-    if redisAddr == "" {
-        redisAddr = "localhost:6379"
-    }
-    
-    proxyPort := os.Getenv("PROXY_PORT")
-    if proxyPort == "" {
-        proxyPort = "8080"
-    }
-
-    pg, err := db.New(ctx, dbURL)
+
+    dbURL := databaseURL()
+    if len(os.Args) > 1 && os.Args[1] == "migrate" {
+        runMigrate(ctx, dbURL, os.Args[2:])
+        return
+    }
+    if len(os.Args) > 1 && os.Args[1] == "apikey" {
+        runAPIKey(ctx, dbURL, os.Args[2:])
+        return
+    }
+    if err := run(ctx, dbURL); err != nil {
+        log.Fatal(err)
+    }
+}
+
+// run serves until SIGINT or SIGTERM. It returns rather than exiting on
+// errors so that the deferred closes run.
+func run(ctx context.Context, dbURL string) error {
+    redisAddr := getEnv("REDIS_ADDR", "localhost:6379")
+    proxyPort := getEnv("PROXY_PORT", "8080")
+    shutdownTimeout := getEnvDuration("SHUTDOWN_TIMEOUT", 25*time.Second)
+    cacheLRUSize := getEnvInt("CACHE_LRU_SIZE", 10000)
+    cacheL1TTL := getEnvDuration("CACHE_L1_TTL", 30*time.Second)
+    negCacheTTL := getEnvDuration("NEG_CACHE_TTL", 30*time.Second)
+    ttlPolicies, err := cache.ParsePolicies(os.Getenv("CACHE_TTL_POLICIES"))
     if err != nil {
-        log.Fatalf("failed connect db: %v", err)
+        return fmt.Errorf("invalid CACHE_TTL_POLICIES: %w", err)
     }
-    defer pg.Close(ctx)
+    cachePolicies := cache.NewPolicies(cache.Policy{TTL: cache.DefaultTTL}, ttlPolicies...)
 
-    cacheClient := cache.New(redisAddr)
+    walDir := getEnv("WAL_DIR", "wal")
+    walSync, err := wal.ParseSyncPolicy(getEnv("WAL_SYNC", "always"))
+    if err != nil {
+        return fmt.Errorf("invalid WAL_SYNC: %w", err)
+    }
+    walSegment := getEnvInt("WAL_SEGMENT_BYTES", 64<<20)
+    deadLetterFile := getEnv("DEAD_LETTER_FILE", "deadletter/records.jsonl")
+    flushAttempts := getEnvInt("FLUSH_MAX_ATTEMPTS", batcher.DefaultRetryPolicy.MaxAttempts)
+    overflow, err := batcher.ParseOverflowPolicy(getEnv("QUEUE_OVERFLOW", "block"))
+    if err != nil {
+        return fmt.Errorf("invalid QUEUE_OVERFLOW: %w", err)
+    }
+    queueLimits := batcher.QueueLimits{
+        MaxRecords:   getEnvInt("QUEUE_MAX_RECORDS", 0),
+        MaxBytes:     int64(getEnvInt("QUEUE_MAX_BYTES", 0)),
+        Policy:       overflow,
+        BlockTimeout: getEnvDuration("QUEUE_BLOCK_TIMEOUT", 2*time.Second),
+    }
+    coalesce, err := batcher.ParseCoalescing(os.Getenv("BATCH_COALESCE"))
+    if err != nil {
+        return fmt.Errorf("invalid BATCH_COALESCE: %w", err)
+    }
+    authEnabled := getEnvBool("AUTH_ENABLED", false)
+    apiKeysFile := os.Getenv("API_KEYS_FILE")
+    authCacheTTL := getEnvDuration("AUTH_CACHE_TTL", auth.DefaultCacheTTL)
+    insertStrategy, err := db.ParseInsertStrategy(getEnv("DB_INSERT_STRATEGY", "copy"))
+    if err != nil {
+        return fmt.Errorf("invalid DB_INSERT_STRATEGY: %w", err)
+    }
 
-    b := batcher.New(pg, 50, 2*time.Second)
-    go b.Run(ctx)
+    var store db.Store
+    switch backend := getEnv("STORE_BACKEND", "postgres"); backend {
+    case "postgres":
+        connect := db.New
+        if !getEnvBool("DB_AUTO_MIGRATE", true) {
+            connect = db.Connect
+        }
+        pg, err := connect(ctx, dbURL)
+        if err != nil {
+            return fmt.Errorf("failed connect db: %w", err)
+        }
+        pg.SetInsertStrategy(insertStrategy)
+        store = pg
+    case "memory":
+        log.Println("using in-memory store; data is not persisted across restarts")
+        store = db.NewMemory()
+    default:
+        return fmt.Errorf("invalid STORE_BACKEND %q", backend)
+    }
+    // the batcher uses the store, cache, WAL and dead-letter file until Run
+    // returns; a shutdown that times out leaves them open rather than
+    // closing them under a flush
+    batcherRunning := false
+    closeIdle := func(close func()) func() {
+        return func() {
+            if !batcherRunning {
+                close()
+            }
+        }
+    }
+    defer closeIdle(func() { store.Close(ctx) })()
 
-    h := handler.New(pg, cacheClient, b)
+    cacheMode := getEnv("CACHE_MODE", "redis")
+    var cacheClient cache.Cache
+    switch cacheMode {
+    case "redis":
+        cacheClient = cache.New(redisAddr, cache.WithPolicies(cachePolicies))
+    case "lru":
+        cacheClient = cache.NewLRU(cacheLRUSize, 0, cache.WithPolicies(cachePolicies))
+    case "tiered":
+        // L1 follows the policies but never keeps an entry longer than
+        // CACHE_L1_TTL, which bounds staleness
+        l1 := cache.NewLRU(cacheLRUSize, cacheL1TTL, cache.WithPolicies(cachePolicies.Capped(cacheL1TTL)))
+        cacheClient = cache.NewTiered(l1, cache.New(redisAddr, cache.WithPolicies(cachePolicies)))
+    default:
+        return fmt.Errorf("invalid CACHE_MODE %q", cacheMode)
+    }
+    defer closeIdle(func() { _ = cacheClient.Close() })()
+
+    wlog, err := wal.Open(walDir, wal.Options{SegmentSize: int64(walSegment), Sync: walSync})
+    if err != nil {
+        return fmt.Errorf("failed open wal: %w", err)
+    }
+    defer closeIdle(func() { _ = wlog.Close() })()
+
+    dlq, err := deadletter.Open(deadLetterFile)
+    if err != nil {
+        return fmt.Errorf("failed open dead-letter file: %w", err)
+    }
+    defer closeIdle(func() { _ = dlq.Close() })()
+
+    retry := batcher.DefaultRetryPolicy
+    retry.MaxAttempts = flushAttempts
+    batchOpts := []batcher.Option{
+        batcher.WithWAL(wlog),
+        batcher.WithRetry(retry),
+        batcher.WithDeadLetter(dlq),
+        batcher.WithQueueLimits(queueLimits),
+        batcher.WithWorkers(getEnvInt("FLUSH_WORKERS", 1)),
+    }
+    if len(coalesce) > 0 {
+        batchOpts = append(batchOpts, batcher.WithCoalescing(batcher.NewCoalescing(coalesce...)))
+    }
+    if getEnvBool("BATCH_ADAPTIVE", false) {
+        batchOpts = append(batchOpts, batcher.WithAdaptive(batcher.AdaptiveConfig{
+            MinBatch:      getEnvInt("BATCH_MIN_SIZE", 10),
+            MaxBatch:      getEnvInt("BATCH_MAX_SIZE", 1000),
+            MinLinger:     getEnvDuration("BATCH_MIN_LINGER", 5*time.Millisecond),
+            MaxLinger:     getEnvDuration("BATCH_MAX_LINGER", 2*time.Second),
+            TargetLatency: getEnvDuration("BATCH_TARGET_LATENCY", 100*time.Millisecond),
+        }))
+    }
+    b := batcher.New(store, getEnvInt("BATCH_SIZE", 50), getEnvDuration("BATCH_INTERVAL", 2*time.Second), batchOpts...)
+    opts := []handler.Option{
+        handler.WithDeadLetter(dlq),
+        handler.WithNegativeTTL(negCacheTTL),
+        handler.WithReadiness(handler.ReadyConfig{
+            MaxQueue:     getEnvInt("READY_MAX_QUEUE", handler.DefaultReadyConfig.MaxQueue),
+            MaxStoreDown: getEnvDuration("READY_MAX_STORE_DOWN", handler.DefaultReadyConfig.MaxStoreDown),
+        }),
+    }
+    if authEnabled {
+        var keys auth.Chain
+        if apiKeysFile != "" {
+            static, err := auth.LoadStaticKeys(apiKeysFile)
+            if err != nil {
+                return fmt.Errorf("failed load API_KEYS_FILE: %w", err)
+            }
+            keys = append(keys, static)
+        }
+        if pg, ok := store.(*db.DB); ok {
+            keys = append(keys, pg)
+        }
+        authOpts := []auth.Option{auth.WithCacheTTL(authCacheTTL)}
+        if v := jwtVerifier(); v != nil {
+            authOpts = append(authOpts, auth.WithJWT(v))
+        }
+        opts = append(opts, handler.WithAuth(auth.New(keys, authOpts...)))
+    }
+    limits := &ratelimit.Policy{
+        PerKey:  ratelimit.Limit{Rate: getEnvFloat("RATE_LIMIT_KEY_RPS", 0), Burst: getEnvInt("RATE_LIMIT_KEY_BURST", 0)},
+        PerUser: ratelimit.Limit{Rate: getEnvFloat("RATE_LIMIT_USER_RPS", 0), Burst: getEnvInt("RATE_LIMIT_USER_BURST", 0)},
+    }
+    if limits.PerKey.Enabled() || limits.PerUser.Enabled() {
+        // without Redis for the cache there is no Redis to share buckets in
+        def := "redis"
+        if cacheMode == "lru" {
+            def = "local"
+        }
+        switch backend := getEnv("RATE_LIMIT_BACKEND", def); backend {
+        case "redis":
+            rl := ratelimit.NewRedis(redisAddr)
+            defer rl.Close()
+            limits.Limiter = rl
+        case "local":
+            limits.Limiter = ratelimit.NewLocal()
+        default:
+            return fmt.Errorf("invalid RATE_LIMIT_BACKEND %q", backend)
+        }
+        opts = append(opts, handler.WithRateLimit(limits))
+    }
+    h := handler.New(store, cacheClient, b, opts...)
 
     srv := &http.Server{
         Addr:    ":" + proxyPort,
         Handler: h.Routes(),
     }
 
-    log.Println("dsProxy running on :" + proxyPort)
-    if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-        log.Fatalf("server error: %v", err)
+    runCtx, stopBatcher := context.WithCancel(ctx)
+    defer stopBatcher()
+    batcherDone := make(chan struct{})
+    batcherRunning = true
+    go func() {
+        b.Run(runCtx)
+        close(batcherDone)
+    }()
+
+    sigCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+    defer stop()
+    serveErr := make(chan error, 1)
+    go func() {
+        log.Println("dsProxy running on :" + proxyPort)
+        serveErr <- srv.ListenAndServe()
+    }()
+    var failed error
+    select {
+    case err := <-serveErr:
+        // still drain the batcher; what it cannot flush stays in the WAL
+        failed = fmt.Errorf("server error: %w", err)
+    case <-sigCtx.Done():
+    }
+    // a second signal kills the process
+    stop()
+    log.Printf("shutting down, waiting up to %s", shutdownTimeout)
+
+    shutdownCtx, cancel := context.WithTimeout(ctx, shutdownTimeout)
+    defer cancel()
+    // stop accepting connections and let in-flight requests enqueue
+    if err := srv.Shutdown(shutdownCtx); err != nil {
+        log.Printf("server shutdown: %v", err)
+    }
+    stopBatcher()
+    select {
+    case <-batcherDone:
+        batcherRunning = false
+        log.Println("batcher drained")
+    case <-shutdownCtx.Done():
+        // the flush still holds the WAL and the store: leave them open, and
+        // the untruncated WAL is replayed on the next start
+        log.Println("shutdown timed out before the final flush finished; unflushed records stay in the WAL")
     }
+    // the deferred closes release the WAL, Redis clients and the pool once
+    // the batcher is done with them
+    return failed
+}
+
+// databaseURL builds the Postgres URL from the DB_* variables.
+func databaseURL() string {
+    dbHost := getEnv("DB_HOST", "localhost")
+    dbPort := getEnv("DB_PORT", "5432")
+    dbUser := getEnv("DB_USER", "postgres")
+    dbPass := getEnv("DB_PASS", "postgres")
+    dbName := getEnv("DB_NAME", "mydb")
 
-    // graceful shutdown omitted for brevity
-    _ = ctx
+    return "postgres://" + dbUser + ":" + dbPass + "@" + dbHost + ":" + dbPort + "/" + dbName + "?sslmode=disable"
+}
+
+// jwtVerifier builds the bearer JWT verifier from the JWT_* variables, or
+// returns nil when no key set is configured.
+func jwtVerifier() *auth.JWTVerifier {
+    var keys auth.KeySet
+    if url := os.Getenv("JWT_JWKS_URL"); url != "" {
+        keys = auth.NewRemoteJWKS(url)
+    } else if path := os.Getenv("JWT_JWKS_FILE"); path != "" {
+        ks, err := auth.LoadJWKSFile(path)
+        if err != nil {
+            log.Fatalf("failed load JWT_JWKS_FILE: %v", err)
+        }
+        keys = ks
+    } else {
+        return nil
+    }
+    names := strings.Split(getEnv("JWT_SCOPES", "read,write"), ",")
+    if err := auth.ValidateScopes(names); err != nil {
+        log.Fatalf("invalid JWT_SCOPES: %v", err)
+    }
+    var scopes []auth.Scope
+    for _, s := range names {
+        scopes = append(scopes, auth.Scope(s))
+    }
+    return auth.NewJWTVerifier(auth.JWTConfig{
+        Keys:      keys,
+        Issuer:    os.Getenv("JWT_ISSUER"),
+        Audience:  os.Getenv("JWT_AUDIENCE"),
+        UserClaim: getEnv("JWT_USER_CLAIM", "sub"),
+        Scopes:    scopes,
+        Leeway:    getEnvDuration("JWT_LEEWAY", 30*time.Second),
+    })
+}
+
+func getEnv(key, def string) string {
+    if v := os.Getenv(key); v != "" {
+        return v
+    }
+    return def
+}
+
+func getEnvInt(key string, def int) int {
+    v := os.Getenv(key)
+    if v == "" {
+        return def
+    }
+    n, err := strconv.Atoi(v)
+    if err != nil {
+        log.Fatalf("invalid %s: %v", key, err)
+    }
+    return n
+}
+
+func getEnvFloat(key string, def float64) float64 {
+    v := os.Getenv(key)
+    if v == "" {
+        return def
+    }
+    f, err := strconv.ParseFloat(v, 64)
+    if err != nil {
+        log.Fatalf("invalid %s: %v", key, err)
+    }
+    return f
+}
+
+func getEnvDuration(key string, def time.Duration) time.Duration {
+    v := os.Getenv(key)
+    if v == "" {
+        return def
+    }
+    d, err := time.ParseDuration(v)
+    if err != nil {
+        log.Fatalf("invalid %s: %v", key, err)
+    }
+    return d
+}
+
+func getEnvBool(key string, def bool) bool {
+    v := os.Getenv(key)
+    if v == "" {
+        return def
+    }
+    b, err := strconv.ParseBool(v)
+    if err != nil {
+        log.Fatalf("invalid %s: %v", key, err)
+    }
+    return b
 }
@@ -0,0 +1,71 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "os"
+    "strconv"
+
+    "github.com/yourname/dsproxy/pkg/db"
+)
+
+const migrateUsage = `usage: dsproxy migrate [command]
+
+commands:
+  up          apply all pending migrations (default)
+  down [n]    revert the last n applied migrations (default 1)
+  status      print the current schema version and pending migrations`
+
+// runMigrate implements the "dsproxy migrate" subcommand.
+func runMigrate(ctx context.Context, dbURL string, args []string) {
+    cmd := "up"
+    if len(args) > 0 {
+        cmd, args = args[0], args[1:]
+    }
+
+    d, err := db.Connect(ctx, dbURL)
+    if err != nil {
+        log.Fatalf("failed connect db: %v", err)
+    }
+    defer d.Close(ctx)
+
+    switch cmd {
+    case "up":
+        applied, err := d.Migrate(ctx)
+        if err != nil {
+            log.Fatalf("migrate up: %v", err)
+        }
+        if len(applied) == 0 {
+            fmt.Println("schema is up to date")
+        }
+    case "down":
+        steps := 1
+        if len(args) > 0 {
+            if steps, err = strconv.Atoi(args[0]); err != nil || steps <= 0 {
+                log.Fatalf("invalid step count %q", args[0])
+            }
+        }
+        if _, err := d.Rollback(ctx, steps); err != nil {
+            log.Fatalf("migrate down: %v", err)
+        }
+    case "status":
+        current, err := d.SchemaVersion(ctx)
+        if err != nil {
+            log.Fatalf("migrate status: %v", err)
+        }
+        all, err := db.Migrations()
+        if err != nil {
+            log.Fatalf("migrate status: %v", err)
+        }
+        fmt.Printf("schema version: %d\n", current)
+        for _, m := range all {
+            if m.Version > current {
+                fmt.Printf("pending: %d_%s\n", m.Version, m.Name)
+            }
+        }
+    default:
+        fmt.Fprintln(os.Stderr, migrateUsage)
+        os.Exit(2)
+    }
+}
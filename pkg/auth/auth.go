@@ -0,0 +1,237 @@
+// Package auth authenticates HTTP requests with API keys or JWTs and
+// authorizes them by scope and user_id.
+package auth
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/promauto"
+    "github.com/yourname/dsproxy/pkg/db"
+)
+
+// Scope is a permission granted to a key.
+type Scope string
+
+const (
+    ScopeRead    Scope = "read"
+    ScopeWrite   Scope = "write"
+    ScopeMetrics Scope = "metrics"
+    // ScopeAdmin grants every other scope as well.
+    ScopeAdmin Scope = "admin"
+)
+
+const (
+    apiKeyHeader = "X-API-Key"
+
+    // DefaultCacheTTL is how long a looked-up key is trusted before it is
+    // looked up again, i.e. how long a revoked key keeps working.
+    DefaultCacheTTL = time.Minute
+)
+
+var failuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+    Name: "dsproxy_auth_failures_total",
+    Help: "Rejected requests by reason.",
+}, []string{"reason"})
+
+// ValidateScopes reports an error for any unknown scope name.
+func ValidateScopes(scopes []string) error {
+    for _, s := range scopes {
+        switch Scope(s) {
+        case ScopeRead, ScopeWrite, ScopeMetrics, ScopeAdmin:
+        default:
+            return fmt.Errorf("unknown scope %q", s)
+        }
+    }
+    return nil
+}
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+    Name string
+    // KeyID identifies an API key for as long as it exists: the hash it is
+    // stored under. Unlike Name it is unique and does not change. Empty for
+    // tokens.
+    KeyID      string
+    Scopes     []Scope
+    UserPrefix string
+    // UserID, when set, is the only user the principal may access.
+    UserID string
+}
+
+func newPrincipal(hash string, k *db.APIKey) *Principal {
+    p := &Principal{Name: k.Name, KeyID: hash, UserPrefix: k.UserPrefix}
+    for _, s := range k.Scopes {
+        p.Scopes = append(p.Scopes, Scope(s))
+    }
+    return p
+}
+
+func (p *Principal) Has(scope Scope) bool {
+    for _, s := range p.Scopes {
+        if s == scope || s == ScopeAdmin {
+            return true
+        }
+    }
+    return false
+}
+
+// AllowsUser reports whether p may access user's data.
+func (p *Principal) AllowsUser(user string) bool {
+    if p.UserID != "" {
+        return user == p.UserID
+    }
+    return strings.HasPrefix(user, p.UserPrefix)
+}
+
+type ctxKey struct{}
+
+// FromContext returns the principal of an authenticated request.
+func FromContext(ctx context.Context) (*Principal, bool) {
+    p, ok := ctx.Value(ctxKey{}).(*Principal)
+    return p, ok
+}
+
+// AllowUser reports whether the request behind ctx may access user's data.
+// Requests that did not go through an Authenticator are allowed.
+func AllowUser(ctx context.Context, user string) bool {
+    p, ok := FromContext(ctx)
+    return !ok || p.AllowsUser(user)
+}
+
+// AllowScope reports whether the request behind ctx has scope. Requests
+// that did not go through an Authenticator are allowed.
+func AllowScope(ctx context.Context, scope Scope) bool {
+    p, ok := FromContext(ctx)
+    return !ok || p.Has(scope)
+}
+
+// Authenticator checks API keys sent as "Authorization: Bearer <key>" or
+// in the X-API-Key header, and, with WithJWT, bearer JWTs.
+type Authenticator struct {
+    keys     KeyStore
+    jwt      *JWTVerifier
+    cacheTTL time.Duration
+
+    mu    sync.Mutex
+    cache map[string]cachedKey // by key hash
+}
+
+type cachedKey struct {
+    p       *Principal
+    expires time.Time
+}
+
+type Option func(*Authenticator)
+
+// WithCacheTTL overrides DefaultCacheTTL. Zero disables caching.
+func WithCacheTTL(ttl time.Duration) Option {
+    return func(a *Authenticator) { a.cacheTTL = ttl }
+}
+
+// WithJWT accepts JWTs verified by v as bearer tokens.
+func WithJWT(v *JWTVerifier) Option {
+    return func(a *Authenticator) { a.jwt = v }
+}
+
+func New(keys KeyStore, opts ...Option) *Authenticator {
+    a := &Authenticator{
+        keys:     keys,
+        cacheTTL: DefaultCacheTTL,
+        cache:    make(map[string]cachedKey),
+    }
+    for _, opt := range opts {
+        opt(a)
+    }
+    return a
+}
+
+// Require wraps next so that it only runs for requests carrying a key with
+// scope. It answers 401 for a missing or unknown key and 403 for a key
+// without the scope.
+func (a *Authenticator) Require(scope Scope, next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        key, bearer := credential(r)
+        if key == "" {
+            failuresTotal.WithLabelValues("missing").Inc()
+            w.Header().Set("WWW-Authenticate", "Bearer")
+            http.Error(w, "missing api key", http.StatusUnauthorized)
+            return
+        }
+        if bearer && a.jwt != nil && looksLikeJWT(key) {
+            p, err := a.jwt.Verify(r.Context(), key)
+            if err != nil {
+                failuresTotal.WithLabelValues("token").Inc()
+                w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+                http.Error(w, err.Error(), http.StatusUnauthorized)
+                return
+            }
+            a.serve(w, r, scope, p, next)
+            return
+        }
+        p, err := a.authenticate(r.Context(), key)
+        if errors.Is(err, db.ErrNotFound) {
+            failuresTotal.WithLabelValues("invalid").Inc()
+            w.Header().Set("WWW-Authenticate", "Bearer")
+            http.Error(w, "invalid api key", http.StatusUnauthorized)
+            return
+        } else if err != nil {
+            log.Printf("api key lookup error: %v", err)
+            http.Error(w, "auth error", http.StatusInternalServerError)
+            return
+        }
+        a.serve(w, r, scope, p, next)
+    })
+}
+
+func (a *Authenticator) serve(w http.ResponseWriter, r *http.Request, scope Scope, p *Principal, next http.Handler) {
+    if !p.Has(scope) {
+        failuresTotal.WithLabelValues("scope").Inc()
+        http.Error(w, "missing scope "+string(scope), http.StatusForbidden)
+        return
+    }
+    next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxKey{}, p)))
+}
+
+func (a *Authenticator) authenticate(ctx context.Context, key string) (*Principal, error) {
+    hash := HashKey(key)
+    now := time.Now()
+    a.mu.Lock()
+    c, ok := a.cache[hash]
+    a.mu.Unlock()
+    if ok && now.Before(c.expires) {
+        return c.p, nil
+    }
+
+    k, err := a.keys.LookupAPIKey(ctx, hash)
+    if err != nil {
+        return nil, err
+    }
+    p := newPrincipal(hash, k)
+    if a.cacheTTL > 0 {
+        a.mu.Lock()
+        a.cache[hash] = cachedKey{p: p, expires: now.Add(a.cacheTTL)}
+        a.mu.Unlock()
+    }
+    return p, nil
+}
+
+// credential returns the request's key or token and whether it came as a
+// bearer token.
+func credential(r *http.Request) (string, bool) {
+    if v := r.Header.Get("Authorization"); v != "" {
+        scheme, token, ok := strings.Cut(v, " ")
+        if ok && strings.EqualFold(scheme, "Bearer") {
+            return strings.TrimSpace(token), true
+        }
+        return "", false
+    }
+    return r.Header.Get(apiKeyHeader), false
+}
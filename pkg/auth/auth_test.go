@@ -0,0 +1,411 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yourname/dsproxy/pkg/db"
+)
+
+// countingStore counts lookups that reach the underlying store.
+type countingStore struct {
+	KeyStore
+	calls atomic.Int32
+}
+
+func (c *countingStore) LookupAPIKey(ctx context.Context, hash string) (*db.APIKey, error) {
+	c.calls.Add(1)
+	return c.KeyStore.LookupAPIKey(ctx, hash)
+}
+
+func TestGenerateKey(t *testing.T) {
+	a, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	b, _ := GenerateKey()
+	if a == b || !strings.HasPrefix(a, keyPrefix) {
+		t.Errorf("GenerateKey() = %q, %q", a, b)
+	}
+	if HashKey(a) == HashKey(b) || len(HashKey(a)) != 64 {
+		t.Errorf("HashKey() = %q", HashKey(a))
+	}
+}
+
+func TestLoadStaticKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{
+			name:    "plain and hashed keys",
+			content: `[{"name":"a","key":"secret","scopes":["read"]},{"name":"b","key_sha256":"` + HashKey("other") + `","scopes":["admin"],"user_prefix":"t1:"}]`,
+		},
+		{
+			name:    "unknown scope",
+			content: `[{"name":"a","key":"secret","scopes":["root"]}]`,
+			wantErr: true,
+		},
+		{
+			name:    "no key",
+			content: `[{"name":"a","scopes":["read"]}]`,
+			wantErr: true,
+		},
+		{
+			name:    "not json",
+			content: `secret`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "keys.json")
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			keys, err := LoadStaticKeys(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadStaticKeys() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			k, err := keys.LookupAPIKey(context.Background(), HashKey("other"))
+			if err != nil || k.Name != "b" || k.UserPrefix != "t1:" {
+				t.Errorf("LookupAPIKey(other) = %+v, %v", k, err)
+			}
+			if _, err := keys.LookupAPIKey(context.Background(), HashKey("nope")); err != db.ErrNotFound {
+				t.Errorf("LookupAPIKey(nope) error = %v, want ErrNotFound", err)
+			}
+		})
+	}
+}
+
+func TestAuthenticator_Require(t *testing.T) {
+	keys := StaticKeys{
+		HashKey("reader"):  {Name: "reader", Scopes: []string{"read"}},
+		HashKey("admin"):   {Name: "admin", Scopes: []string{"admin"}},
+		HashKey("tenant1"): {Name: "tenant1", Scopes: []string{"read", "write"}, UserPrefix: "t1:"},
+	}
+	a := New(keys)
+	var gotPrincipal *Principal
+	h := a.Require(ScopeWrite, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPrincipal, _ = FromContext(r.Context())
+	}))
+
+	tests := []struct {
+		name     string
+		header   string
+		value    string
+		wantCode int
+	}{
+		{"no key", "", "", http.StatusUnauthorized},
+		{"unknown key", "X-API-Key", "guess", http.StatusUnauthorized},
+		{"missing scope", "X-API-Key", "reader", http.StatusForbidden},
+		{"bearer", "Authorization", "Bearer tenant1", http.StatusOK},
+		{"admin implies write", "Authorization", "bearer admin", http.StatusOK},
+		{"other scheme", "Authorization", "Basic admin", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/write", nil)
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			if w.Code != tt.wantCode {
+				t.Errorf("status = %v, want %v", w.Code, tt.wantCode)
+			}
+		})
+	}
+
+	if gotPrincipal == nil || gotPrincipal.Name != "admin" || gotPrincipal.KeyID != HashKey("admin") {
+		t.Fatalf("principal = %+v, want admin", gotPrincipal)
+	}
+}
+
+func TestPrincipal_AllowsUser(t *testing.T) {
+	ctx := context.Background()
+	if !AllowUser(ctx, "anyone") {
+		t.Error("AllowUser() without a principal = false, want true")
+	}
+	p := &Principal{UserPrefix: "t1:"}
+	ctx = context.WithValue(ctx, ctxKey{}, p)
+	tests := []struct {
+		user string
+		want bool
+	}{
+		{"t1:alice", true},
+		{"t2:bob", false},
+		{"t1", false},
+	}
+	for _, tt := range tests {
+		if got := AllowUser(ctx, tt.user); got != tt.want {
+			t.Errorf("AllowUser(%s) = %v, want %v", tt.user, got, tt.want)
+		}
+	}
+}
+
+func TestAuthenticator_Cache(t *testing.T) {
+	store := &countingStore{KeyStore: StaticKeys{HashKey("k"): {Name: "k", Scopes: []string{"read"}}}}
+	a := New(store, WithCacheTTL(50*time.Millisecond))
+	h := a.Require(ScopeRead, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	call := func() {
+		req := httptest.NewRequest(http.MethodGet, "/read", nil)
+		req.Header.Set("X-API-Key", "k")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	for i := 0; i < 3; i++ {
+		call()
+	}
+	if got := store.calls.Load(); got != 1 {
+		t.Errorf("lookups = %d, want 1", got)
+	}
+	time.Sleep(60 * time.Millisecond)
+	call()
+	if got := store.calls.Load(); got != 2 {
+		t.Errorf("lookups after ttl = %d, want 2", got)
+	}
+}
+
+// testIssuer signs tokens with an RSA and an EC key and serves them as a JWKS.
+type testIssuer struct {
+	rsa *rsa.PrivateKey
+	ec  *ecdsa.PrivateKey
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+	rk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ek, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testIssuer{rsa: rk, ec: ek}
+}
+
+func (ti *testIssuer) jwks() []byte {
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	doc := map[string]any{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa1", "use": "sig", "n": b64(ti.rsa.N.Bytes()), "e": b64(big.NewInt(int64(ti.rsa.E)).Bytes())},
+		{"kty": "EC", "kid": "ec1", "crv": "P-256", "x": b64(ti.ec.X.FillBytes(make([]byte, 32))), "y": b64(ti.ec.Y.FillBytes(make([]byte, 32)))},
+	}}
+	data, _ := json.Marshal(doc)
+	return data
+}
+
+func (ti *testIssuer) sign(t *testing.T, alg, kid string, claims map[string]any) string {
+	t.Helper()
+	hdr, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	body, _ := json.Marshal(claims)
+	input := base64.RawURLEncoding.EncodeToString(hdr) + "." + base64.RawURLEncoding.EncodeToString(body)
+	digest := sha256.Sum256([]byte(input))
+	var sig []byte
+	switch alg {
+	case "RS256":
+		s, err := rsa.SignPKCS1v15(rand.Reader, ti.rsa, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = s
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, ti.ec, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWTVerifier_Verify(t *testing.T) {
+	ti := newTestIssuer(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(ti.jwks())
+	}))
+	defer srv.Close()
+
+	v := NewJWTVerifier(JWTConfig{
+		Keys:      NewRemoteJWKS(srv.URL),
+		Issuer:    "https://idp.example",
+		Audience:  "dsproxy",
+		UserClaim: "uid",
+		Scopes:    []Scope{ScopeRead, ScopeWrite},
+	})
+	now := time.Now().Unix()
+	claims := func(extra map[string]any) map[string]any {
+		c := map[string]any{"iss": "https://idp.example", "aud": "dsproxy", "uid": "alice", "exp": now + 60}
+		for k, val := range extra {
+			c[k] = val
+		}
+		return c
+	}
+
+	tests := []struct {
+		name       string
+		token      string
+		wantErr    bool
+		wantScopes []Scope
+	}{
+		{name: "rs256", token: ti.sign(t, "RS256", "rsa1", claims(nil)), wantScopes: []Scope{ScopeRead, ScopeWrite}},
+		{name: "es256", token: ti.sign(t, "ES256", "ec1", claims(nil)), wantScopes: []Scope{ScopeRead, ScopeWrite}},
+		{name: "aud array", token: ti.sign(t, "RS256", "rsa1", claims(map[string]any{"aud": []string{"other", "dsproxy"}})), wantScopes: []Scope{ScopeRead, ScopeWrite}},
+		{name: "scope claim", token: ti.sign(t, "RS256", "rsa1", claims(map[string]any{"scope": "openid read"})), wantScopes: []Scope{ScopeRead}},
+		{name: "scope claim above config", token: ti.sign(t, "RS256", "rsa1", claims(map[string]any{"scope": "read admin"})), wantScopes: []Scope{ScopeRead}},
+		{name: "expired", token: ti.sign(t, "RS256", "rsa1", claims(map[string]any{"exp": now - 60})), wantErr: true},
+		{name: "not yet valid", token: ti.sign(t, "RS256", "rsa1", claims(map[string]any{"nbf": now + 60})), wantErr: true},
+		{name: "no exp", token: ti.sign(t, "RS256", "rsa1", claims(map[string]any{"exp": nil})), wantErr: true},
+		{name: "wrong issuer", token: ti.sign(t, "RS256", "rsa1", claims(map[string]any{"iss": "https://evil.example"})), wantErr: true},
+		{name: "wrong audience", token: ti.sign(t, "RS256", "rsa1", claims(map[string]any{"aud": "other"})), wantErr: true},
+		{name: "missing user claim", token: ti.sign(t, "RS256", "rsa1", claims(map[string]any{"uid": ""})), wantErr: true},
+		{name: "unknown kid", token: ti.sign(t, "RS256", "rsa2", claims(nil)), wantErr: true},
+		{name: "alg none", token: ti.sign(t, "none", "rsa1", claims(nil)), wantErr: true},
+		{name: "alg mismatch", token: ti.sign(t, "ES256", "rsa1", claims(nil)), wantErr: true},
+		{name: "tampered", token: ti.sign(t, "RS256", "rsa1", claims(nil)) + "A", wantErr: true},
+		{name: "garbage", token: "a.b.c", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := v.Verify(context.Background(), tt.token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if p.UserID != "alice" || fmt.Sprint(p.Scopes) != fmt.Sprint(tt.wantScopes) {
+				t.Errorf("Verify() = %+v", p)
+			}
+			if !p.AllowsUser("alice") || p.AllowsUser("alice2") || p.AllowsUser("bob") {
+				t.Errorf("principal for alice allows the wrong users")
+			}
+		})
+	}
+}
+
+func TestRemoteJWKS_Throttle(t *testing.T) {
+	ti := newTestIssuer(t)
+	var fetches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		time.Sleep(20 * time.Millisecond)
+		_, _ = w.Write(ti.jwks())
+	}))
+	defer srv.Close()
+	keys := NewRemoteJWKS(srv.URL)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := keys.Key(ctx, "rsa1"); err != nil {
+				t.Errorf("Key(rsa1) error = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("concurrent first lookups fetched %d times, want 1", n)
+	}
+
+	// neither an unknown kid nor a stale set refetches within jwksMinRefetch
+	if _, err := keys.Key(ctx, "rsa2"); err == nil {
+		t.Error("Key(rsa2) succeeded for an unknown kid")
+	}
+	keys.mu.Lock()
+	keys.fetched = time.Now().Add(-2 * jwksMaxAge)
+	keys.mu.Unlock()
+	if _, err := keys.Key(ctx, "ec1"); err != nil {
+		t.Errorf("Key(ec1) from a stale set error = %v", err)
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("fetched %d times, want 1", n)
+	}
+}
+
+func TestLoadJWKSFile(t *testing.T) {
+	ti := newTestIssuer(t)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, ti.jwks(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := LoadJWKSFile(path)
+	if err != nil {
+		t.Fatalf("LoadJWKSFile() error = %v", err)
+	}
+	v := NewJWTVerifier(JWTConfig{Keys: keys})
+	token := ti.sign(t, "ES256", "ec1", map[string]any{"sub": "bob", "exp": time.Now().Add(time.Minute).Unix()})
+	if p, err := v.Verify(context.Background(), token); err != nil || p.UserID != "bob" {
+		t.Errorf("Verify() = %+v, %v", p, err)
+	}
+}
+
+func TestAuthenticator_JWT(t *testing.T) {
+	ti := newTestIssuer(t)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, ti.jwks(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := LoadJWKSFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := New(StaticKeys{HashKey("admin"): {Name: "admin", Scopes: []string{"admin"}}},
+		WithJWT(NewJWTVerifier(JWTConfig{Keys: keys, Scopes: []Scope{ScopeWrite}})))
+	h := a.Require(ScopeWrite, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !AllowUser(r.Context(), r.URL.Query().Get("user_id")) {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+
+	exp := time.Now().Add(time.Minute).Unix()
+	tests := []struct {
+		name     string
+		auth     string
+		user     string
+		wantCode int
+	}{
+		{"own user", "Bearer " + ti.sign(t, "RS256", "rsa1", map[string]any{"sub": "alice", "exp": exp}), "alice", http.StatusOK},
+		{"other user", "Bearer " + ti.sign(t, "RS256", "rsa1", map[string]any{"sub": "alice", "exp": exp}), "bob", http.StatusForbidden},
+		{"missing scope", "Bearer " + ti.sign(t, "RS256", "rsa1", map[string]any{"sub": "alice", "exp": exp, "scope": "read"}), "alice", http.StatusForbidden},
+		{"expired", "Bearer " + ti.sign(t, "RS256", "rsa1", map[string]any{"sub": "alice", "exp": exp - 120}), "alice", http.StatusUnauthorized},
+		{"api key still works", "Bearer admin", "bob", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/write?user_id="+tt.user, nil)
+			req.Header.Set("Authorization", tt.auth)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			if w.Code != tt.wantCode {
+				t.Errorf("status = %v, want %v", w.Code, tt.wantCode)
+			}
+		})
+	}
+}
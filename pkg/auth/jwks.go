@@ -0,0 +1,231 @@
+package auth
+
+import (
+    "context"
+    "crypto"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rsa"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "math/big"
+    "net/http"
+    "os"
+    "sync"
+    "time"
+
+    "golang.org/x/sync/singleflight"
+)
+
+var errUnknownKey = errors.New("jwt: unknown signing key")
+
+// KeySet resolves the public key a token was signed with by its kid.
+type KeySet interface {
+    Key(ctx context.Context, kid string) (crypto.PublicKey, error)
+}
+
+type jwk struct {
+    Kty string `json:"kty"`
+    Kid string `json:"kid"`
+    Use string `json:"use"`
+    // RSA
+    N string `json:"n"`
+    E string `json:"e"`
+    // EC
+    Crv string `json:"crv"`
+    X   string `json:"x"`
+    Y   string `json:"y"`
+}
+
+// keyMap is a parsed JWKS document.
+type keyMap map[string]crypto.PublicKey
+
+// parseJWKS parses a JWKS document, skipping keys that are not for
+// signatures or of a type we do not verify.
+func parseJWKS(data []byte) (keyMap, error) {
+    var doc struct {
+        Keys []jwk `json:"keys"`
+    }
+    if err := json.Unmarshal(data, &doc); err != nil {
+        return nil, fmt.Errorf("jwks: %w", err)
+    }
+    keys := make(keyMap, len(doc.Keys))
+    for _, k := range doc.Keys {
+        if k.Use != "" && k.Use != "sig" {
+            continue
+        }
+        pub, err := k.publicKey()
+        if err != nil {
+            return nil, fmt.Errorf("jwks: key %q: %w", k.Kid, err)
+        }
+        if pub != nil {
+            keys[k.Kid] = pub
+        }
+    }
+    return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+    switch k.Kty {
+    case "RSA":
+        n, err1 := decodeBigInt(k.N)
+        e, err2 := decodeBigInt(k.E)
+        if err1 != nil || err2 != nil || !e.IsInt64() {
+            return nil, errors.New("invalid RSA key")
+        }
+        return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+    case "EC":
+        if k.Crv != "P-256" {
+            return nil, nil
+        }
+        x, err1 := decodeBigInt(k.X)
+        y, err2 := decodeBigInt(k.Y)
+        if err1 != nil || err2 != nil || !elliptic.P256().IsOnCurve(x, y) {
+            return nil, errors.New("invalid EC key")
+        }
+        return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+    }
+    return nil, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+    b, err := base64.RawURLEncoding.DecodeString(s)
+    if err != nil || len(b) == 0 {
+        return nil, errors.New("invalid base64url integer")
+    }
+    return new(big.Int).SetBytes(b), nil
+}
+
+// lookup finds kid; a token without kid matches the only key of the set.
+func (m keyMap) lookup(kid string) (crypto.PublicKey, error) {
+    if k, ok := m[kid]; ok {
+        return k, nil
+    }
+    if kid == "" && len(m) == 1 {
+        for _, k := range m {
+            return k, nil
+        }
+    }
+    return nil, errUnknownKey
+}
+
+// LoadJWKSFile reads a fixed key set from a JWKS file.
+func LoadJWKSFile(path string) (KeySet, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    keys, err := parseJWKS(data)
+    if err != nil {
+        return nil, fmt.Errorf("%s: %w", path, err)
+    }
+    return staticKeySet(keys), nil
+}
+
+type staticKeySet keyMap
+
+func (s staticKeySet) Key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+    return keyMap(s).lookup(kid)
+}
+
+const (
+    // jwksMaxAge is how long a fetched key set is used before refetching.
+    jwksMaxAge = time.Hour
+    // jwksMinRefetch limits refetches, so tokens with made-up kids cannot
+    // hammer the identity provider and an unreachable one is not retried
+    // on every request.
+    jwksMinRefetch = time.Minute
+)
+
+// RemoteJWKS fetches a key set from a URL, e.g. an OIDC provider's
+// jwks_uri. It refetches hourly, and early when a token names an unknown
+// kid so that key rotation is picked up.
+type RemoteJWKS struct {
+    url     string
+    client  *http.Client
+    fetches singleflight.Group
+
+    mu        sync.Mutex
+    keys      keyMap
+    fetched   time.Time
+    attempted time.Time
+}
+
+func NewRemoteJWKS(url string) *RemoteJWKS {
+    return &RemoteJWKS{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (r *RemoteJWKS) Key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+    r.mu.Lock()
+    keys := r.keys
+    stale := time.Since(r.fetched) > jwksMaxAge
+    refetch := time.Since(r.attempted) > jwksMinRefetch
+    r.mu.Unlock()
+    if keys != nil && !stale {
+        if k, err := keys.lookup(kid); err == nil {
+            return k, nil
+        }
+    }
+    // concurrent callers share one fetch, made without holding r.mu. Callers
+    // without keys join one that may be in flight; refresh itself enforces
+    // jwksMinRefetch.
+    if refetch || keys == nil {
+        _, _, _ = r.fetches.Do("", func() (any, error) {
+            r.refresh(context.WithoutCancel(ctx))
+            return nil, nil
+        })
+        r.mu.Lock()
+        keys = r.keys
+        r.mu.Unlock()
+    }
+    if keys == nil {
+        return nil, errors.New("jwt: no key set available")
+    }
+    // an outdated key set still beats rejecting every token
+    return keys.lookup(kid)
+}
+
+// refresh fetches the key set and swaps it in, unless another refresh ran
+// within jwksMinRefetch.
+func (r *RemoteJWKS) refresh(ctx context.Context) {
+    r.mu.Lock()
+    if time.Since(r.attempted) <= jwksMinRefetch {
+        r.mu.Unlock()
+        return
+    }
+    r.attempted = time.Now()
+    r.mu.Unlock()
+
+    keys, err := r.fetch(ctx)
+    if err != nil {
+        log.Printf("jwks fetch %s: %v", r.url, err)
+        return
+    }
+    r.mu.Lock()
+    r.keys, r.fetched = keys, time.Now()
+    r.mu.Unlock()
+}
+
+func (r *RemoteJWKS) fetch(ctx context.Context) (keyMap, error) {
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url, nil)
+    if err != nil {
+        return nil, err
+    }
+    res, err := r.client.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer res.Body.Close()
+    if res.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("status %s", res.Status)
+    }
+    data, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+    if err != nil {
+        return nil, err
+    }
+    return parseJWKS(data)
+}
@@ -0,0 +1,191 @@
+package auth
+
+import (
+    "context"
+    "crypto"
+    "crypto/ecdsa"
+    "crypto/rsa"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "math/big"
+    "strings"
+    "time"
+)
+
+var errInvalidToken = errors.New("jwt: invalid token")
+
+// JWTConfig configures bearer-token validation.
+type JWTConfig struct {
+    Keys KeySet
+    // Issuer and Audience, when set, must match the iss and aud claims.
+    Issuer   string
+    Audience string
+    // UserClaim names the claim holding the only user_id a token may
+    // access. Defaults to "sub".
+    UserClaim string
+    // Scopes are granted to tokens without a "scope" claim, and bound the
+    // scopes a token with one gets.
+    Scopes []Scope
+    // Leeway absorbs clock skew when checking exp and nbf.
+    Leeway time.Duration
+}
+
+// JWTVerifier checks RS256 and ES256 signed JWTs.
+type JWTVerifier struct {
+    cfg JWTConfig
+}
+
+func NewJWTVerifier(cfg JWTConfig) *JWTVerifier {
+    if cfg.UserClaim == "" {
+        cfg.UserClaim = "sub"
+    }
+    return &JWTVerifier{cfg: cfg}
+}
+
+type jwtHeader struct {
+    Alg string `json:"alg"`
+    Kid string `json:"kid"`
+}
+
+// Verify checks token's signature and claims and returns the principal it
+// stands for, restricted to the user_id in the user claim.
+func (v *JWTVerifier) Verify(ctx context.Context, token string) (*Principal, error) {
+    parts := strings.Split(token, ".")
+    if len(parts) != 3 {
+        return nil, errInvalidToken
+    }
+    var hdr jwtHeader
+    if err := decodeSegment(parts[0], &hdr); err != nil {
+        return nil, errInvalidToken
+    }
+    sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+    if err != nil {
+        return nil, errInvalidToken
+    }
+    key, err := v.cfg.Keys.Key(ctx, hdr.Kid)
+    if err != nil {
+        return nil, err
+    }
+    if err := verifySignature(hdr.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+        return nil, err
+    }
+
+    var claims map[string]any
+    dec := json.NewDecoder(base64.NewDecoder(base64.RawURLEncoding, strings.NewReader(parts[1])))
+    dec.UseNumber()
+    if err := dec.Decode(&claims); err != nil {
+        return nil, errInvalidToken
+    }
+    if err := v.checkClaims(claims, time.Now()); err != nil {
+        return nil, err
+    }
+
+    user, _ := claims[v.cfg.UserClaim].(string)
+    if user == "" {
+        return nil, fmt.Errorf("jwt: missing %s claim", v.cfg.UserClaim)
+    }
+    p := &Principal{Name: user, UserID: user, Scopes: v.cfg.Scopes}
+    if s, ok := claims["scope"].(string); ok {
+        // the configured scopes are the ceiling: a token can only narrow
+        // them. Tokens carry scopes of other services too.
+        ceiling := &Principal{Scopes: v.cfg.Scopes}
+        p.Scopes = nil
+        for _, name := range strings.Fields(s) {
+            if ValidateScopes([]string{name}) == nil && ceiling.Has(Scope(name)) {
+                p.Scopes = append(p.Scopes, Scope(name))
+            }
+        }
+    }
+    return p, nil
+}
+
+func (v *JWTVerifier) checkClaims(claims map[string]any, now time.Time) error {
+    exp, ok := numericDate(claims["exp"])
+    if !ok {
+        return errors.New("jwt: missing exp claim")
+    }
+    if now.After(exp.Add(v.cfg.Leeway)) {
+        return errors.New("jwt: token expired")
+    }
+    if nbf, ok := numericDate(claims["nbf"]); ok && now.Add(v.cfg.Leeway).Before(nbf) {
+        return errors.New("jwt: token not valid yet")
+    }
+    if v.cfg.Issuer != "" && claims["iss"] != v.cfg.Issuer {
+        return errors.New("jwt: wrong issuer")
+    }
+    if v.cfg.Audience != "" && !hasAudience(claims["aud"], v.cfg.Audience) {
+        return errors.New("jwt: wrong audience")
+    }
+    return nil
+}
+
+func verifySignature(alg string, key crypto.PublicKey, input string, sig []byte) error {
+    digest := sha256.Sum256([]byte(input))
+    switch alg {
+    case "RS256":
+        pub, ok := key.(*rsa.PublicKey)
+        if !ok {
+            return errInvalidToken
+        }
+        if rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) != nil {
+            return errInvalidToken
+        }
+        return nil
+    case "ES256":
+        pub, ok := key.(*ecdsa.PublicKey)
+        // JWS uses the fixed-size r||s encoding, not ASN.1
+        if !ok || len(sig) != 64 {
+            return errInvalidToken
+        }
+        r := new(big.Int).SetBytes(sig[:32])
+        s := new(big.Int).SetBytes(sig[32:])
+        if !ecdsa.Verify(pub, digest[:], r, s) {
+            return errInvalidToken
+        }
+        return nil
+    }
+    return fmt.Errorf("jwt: unsupported alg %q", alg)
+}
+
+func decodeSegment(seg string, v any) error {
+    data, err := base64.RawURLEncoding.DecodeString(seg)
+    if err != nil {
+        return err
+    }
+    return json.Unmarshal(data, v)
+}
+
+func numericDate(v any) (time.Time, bool) {
+    n, ok := v.(json.Number)
+    if !ok {
+        return time.Time{}, false
+    }
+    f, err := n.Float64()
+    if err != nil {
+        return time.Time{}, false
+    }
+    return time.Unix(int64(f), 0), true
+}
+
+// hasAudience handles aud being a single string or an array.
+func hasAudience(aud any, want string) bool {
+    switch a := aud.(type) {
+    case string:
+        return a == want
+    case []any:
+        for _, x := range a {
+            if x == want {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// looksLikeJWT tells bearer JWTs from API keys, which contain no dots.
+func looksLikeJWT(token string) bool {
+    return strings.Count(token, ".") == 2
+}
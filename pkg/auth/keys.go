@@ -0,0 +1,104 @@
+package auth
+
+import (
+    "context"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "os"
+
+    "github.com/yourname/dsproxy/pkg/db"
+)
+
+// keyPrefix makes dsProxy keys easy to recognise, e.g. in secret scanners.
+const keyPrefix = "dsp_"
+
+// KeyStore finds API keys by the hex SHA-256 of the key. It returns
+// db.ErrNotFound for unknown or revoked keys. *db.DB is a KeyStore.
+type KeyStore interface {
+    LookupAPIKey(ctx context.Context, hash string) (*db.APIKey, error)
+}
+
+var _ KeyStore = (*db.DB)(nil)
+
+// HashKey returns the form in which key is stored.
+func HashKey(key string) string {
+    sum := sha256.Sum256([]byte(key))
+    return hex.EncodeToString(sum[:])
+}
+
+// GenerateKey returns a new random API key.
+func GenerateKey() (string, error) {
+    var b [32]byte
+    if _, err := rand.Read(b[:]); err != nil {
+        return "", err
+    }
+    return keyPrefix + base64.RawURLEncoding.EncodeToString(b[:]), nil
+}
+
+// StaticKeys is a KeyStore loaded from a file, used to bootstrap access
+// before any key exists in Postgres.
+type StaticKeys map[string]*db.APIKey
+
+// staticKey is one entry of a static keys file. Either Key or KeySHA256 is
+// set; prefer KeySHA256 so the file holds no secrets.
+type staticKey struct {
+    Name       string   `json:"name"`
+    Key        string   `json:"key"`
+    KeySHA256  string   `json:"key_sha256"`
+    Scopes     []string `json:"scopes"`
+    UserPrefix string   `json:"user_prefix"`
+}
+
+// LoadStaticKeys reads a JSON array of keys, e.g.
+//
+//  [{"name": "bootstrap", "key_sha256": "9f86d0...", "scopes": ["admin"]}]
+func LoadStaticKeys(path string) (StaticKeys, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    var entries []staticKey
+    if err := json.Unmarshal(data, &entries); err != nil {
+        return nil, fmt.Errorf("%s: %w", path, err)
+    }
+    keys := make(StaticKeys, len(entries))
+    for i, e := range entries {
+        hash := e.KeySHA256
+        if e.Key != "" {
+            hash = HashKey(e.Key)
+        }
+        if hash == "" {
+            return nil, fmt.Errorf("%s: key %d (%s) has neither key nor key_sha256", path, i, e.Name)
+        }
+        if err := ValidateScopes(e.Scopes); err != nil {
+            return nil, fmt.Errorf("%s: key %d (%s): %w", path, i, e.Name, err)
+        }
+        keys[hash] = &db.APIKey{Name: e.Name, Scopes: e.Scopes, UserPrefix: e.UserPrefix}
+    }
+    return keys, nil
+}
+
+func (s StaticKeys) LookupAPIKey(ctx context.Context, hash string) (*db.APIKey, error) {
+    if k, ok := s[hash]; ok {
+        return k, nil
+    }
+    return nil, db.ErrNotFound
+}
+
+// Chain looks a key up in each store in turn.
+type Chain []KeyStore
+
+func (c Chain) LookupAPIKey(ctx context.Context, hash string) (*db.APIKey, error) {
+    for _, ks := range c {
+        k, err := ks.LookupAPIKey(ctx, hash)
+        if !errors.Is(err, db.ErrNotFound) {
+            return k, err
+        }
+    }
+    return nil, db.ErrNotFound
+}
@@ -0,0 +1,118 @@
+package batcher
+
+import (
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+    batchSizeGauge = promauto.NewGauge(prometheus.GaugeOpts{
+        Name: "dsproxy_batch_size_target",
+        Help: "Queue length at which a flush is triggered.",
+    })
+    lingerGauge = promauto.NewGauge(prometheus.GaugeOpts{
+        Name: "dsproxy_batch_linger_seconds",
+        Help: "Longest a record waits in the queue before a flush is triggered.",
+    })
+    flushSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+        Name:    "dsproxy_batch_flush_duration_seconds",
+        Help:    "Time to write one flush, retries included.",
+        Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+    })
+)
+
+// AdaptiveConfig bounds the batch size and linger time an adaptive batcher
+// tunes itself within.
+type AdaptiveConfig struct {
+    MinBatch int
+    MaxBatch int
+    // MinLinger is raised to minLinger so that a busy batcher does not spin.
+    MinLinger time.Duration
+    // MaxLinger is also the linger of an idle batcher.
+    MaxLinger time.Duration
+    // TargetLatency is the flush duration above which the batch size is
+    // halved. Below it, a flush that filled a whole batch grows the size by
+    // MinBatch.
+    TargetLatency time.Duration
+}
+
+const (
+    // rateSmoothing weighs the latest arrival rate sample against the
+    // history.
+    rateSmoothing = 0.3
+    minLinger     = 5 * time.Millisecond
+)
+
+// tuner adjusts batch size (AIMD on flush latency) and linger (from the
+// arrival rate): when a batch fills within MaxLinger it is worth waiting
+// for, otherwise records are flushed after MinLinger, since waiting would
+// add latency without making batches bigger. An idle batcher waits
+// MaxLinger so that it does not wake up every MinLinger for nothing.
+type tuner struct {
+    cfg      AdaptiveConfig
+    rate     float64 // arrivals per second, smoothed
+    arrivals int     // since the last observation
+    last     time.Time
+}
+
+func newTuner(cfg AdaptiveConfig) *tuner {
+    if cfg.MinBatch < 1 {
+        cfg.MinBatch = 1
+    }
+    if cfg.MaxBatch < cfg.MinBatch {
+        cfg.MaxBatch = cfg.MinBatch
+    }
+    if cfg.MinLinger < minLinger {
+        cfg.MinLinger = minLinger
+    }
+    if cfg.MaxLinger < cfg.MinLinger {
+        cfg.MaxLinger = cfg.MinLinger
+    }
+    return &tuner{cfg: cfg, last: time.Now()}
+}
+
+// clampSize keeps size within the configured bounds.
+func (t *tuner) clampSize(size int) int {
+    return min(max(size, t.cfg.MinBatch), t.cfg.MaxBatch)
+}
+
+// sample folds the arrivals since the last sample into the rate.
+func (t *tuner) sample(now time.Time) {
+    elapsed := now.Sub(t.last).Seconds()
+    if elapsed <= 0 {
+        return
+    }
+    t.rate = rateSmoothing*float64(t.arrivals)/elapsed + (1-rateSmoothing)*t.rate
+    if t.arrivals == 0 && t.rate*t.cfg.MaxLinger.Seconds() < 1 {
+        // not even one record per MaxLinger: idle, rather than decaying
+        // towards zero one MinLinger at a time
+        t.rate = 0
+    }
+    t.arrivals, t.last = 0, now
+}
+
+// adjust returns the batch size after a flush of n records that took d;
+// ok is false when the flush failed.
+func (t *tuner) adjust(size, n int, d time.Duration, ok bool) int {
+    switch {
+    case !ok || d > t.cfg.TargetLatency:
+        size /= 2
+    case n >= size:
+        size += t.cfg.MinBatch
+    }
+    return t.clampSize(size)
+}
+
+// linger returns how long to wait for a batch of size at the current rate.
+func (t *tuner) linger(size int) time.Duration {
+    if t.rate <= 0 {
+        return t.cfg.MaxLinger
+    }
+    fill := time.Duration(float64(size) / t.rate * float64(time.Second))
+    if fill > t.cfg.MaxLinger {
+        return t.cfg.MinLinger
+    }
+    return max(fill, t.cfg.MinLinger)
+}
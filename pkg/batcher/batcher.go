@@ -2,70 +2,610 @@ package batcher
 
 import (
     "context"
+    "encoding/json"
+    "hash/fnv"
+    "log"
+    "math/rand"
+    "sort"
     "sync"
     "time"
 
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/promauto"
     "github.com/yourname/dsproxy/pkg/db"
+    "github.com/yourname/dsproxy/pkg/wal"
 )
 
+var (
+    flushesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+        Name: "dsproxy_batch_flushes_total",
+        Help: "Batch flush attempts by result.",
+    }, []string{"result"})
+    retriesTotal = promauto.NewCounter(prometheus.CounterOpts{
+        Name: "dsproxy_batch_retries_total",
+        Help: "InsertBatch retries after a failed attempt.",
+    })
+    requeuedTotal = promauto.NewCounter(prometheus.CounterOpts{
+        Name: "dsproxy_batch_requeued_records_total",
+        Help: "Records put back on the queue after a transient flush failure.",
+    })
+    deadLetteredTotal = promauto.NewCounter(prometheus.CounterOpts{
+        Name: "dsproxy_batch_dead_lettered_records_total",
+        Help: "Records moved to the dead-letter sink after a permanent failure.",
+    })
+)
+
+// DeadLetterSink stores records that can never be inserted.
+type DeadLetterSink interface {
+    Put(ctx context.Context, recs []db.Record, cause error) error
+}
+
+// RetryPolicy bounds how hard a flush tries before giving up on a batch.
+// Delays grow exponentially from BaseDelay up to MaxDelay with jitter.
+type RetryPolicy struct {
+    MaxAttempts int
+    BaseDelay   time.Duration
+    MaxDelay    time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+    MaxAttempts: 5,
+    BaseDelay:   100 * time.Millisecond,
+    MaxDelay:    5 * time.Second,
+}
+
 type Batcher struct {
-    db        *db.DB
-    batchSize int
-    interval  time.Duration
+    db         db.Store
+    batchSize  int
+    interval   time.Duration
+    wal        *wal.Log
+    retry      RetryPolicy
+    deadLetter DeadLetterSink
+    limits     QueueLimits
+    workers    int
+    coalescing *Coalescing
+    tuner      *tuner // nil unless adaptive; batchSize and interval are then guarded by mu
 
     mu    sync.Mutex
-    queue []db.Record
+    queue []item
     ch    chan struct{}
+
+    // pending counts records accepted but not yet committed, dead-lettered
+    // or dropped, whether queued or being flushed.
+    pending      int
+    pendingBytes int64
+    space        chan struct{} // closed and replaced when pending shrinks
+    // spilled records are only in the WAL, seqs spillFrom..spillTo
+    spillFrom uint64
+    spillTo   uint64
+    spillFuts map[uint64]*Future
+    // dropped holds the WAL seq of each user's last Drop. Records of the
+    // user with a lower seq that are read back from the WAL (spilled, or
+    // not replayed yet) are dropped.
+    dropped map[string]uint64
+    // lastFlush is when a flush last left nothing to retry
+    lastFlush time.Time
+
+    replay sync.Once
+}
+
+// item is a queued record together with its WAL sequence number (0 when the
+// batcher runs without a WAL) and the future its producer may be waiting on.
+// merged holds the futures of older records coalesced into this one.
+type item struct {
+    rec    db.Record
+    seq    uint64
+    fut    *Future
+    merged []*Future
+}
+
+type Option func(*Batcher)
+
+// WithRetry overrides DefaultRetryPolicy.
+func WithRetry(p RetryPolicy) Option {
+    return func(b *Batcher) { b.retry = p }
+}
+
+// WithDeadLetter sets where records that fail permanently are sent. Without
+// a sink such records are logged and dropped.
+func WithDeadLetter(s DeadLetterSink) Option {
+    return func(b *Batcher) { b.deadLetter = s }
 }
 
-func New(d *db.DB, batchSize int, interval time.Duration) *Batcher {
-    return &Batcher{
+// WithWAL makes Enqueue append every record to l before acknowledging it.
+// Flushed records are truncated from the log and Run replays whatever is left
+// from a previous process.
+func WithWAL(l *wal.Log) Option {
+    return func(b *Batcher) { b.wal = l }
+}
+
+// WithQueueLimits bounds the records held in memory. Without it the queue
+// grows as long as the store is slower than producers.
+func WithQueueLimits(l QueueLimits) Option {
+    return func(b *Batcher) { b.limits = l }
+}
+
+// WithAdaptive makes the batcher tune its batch size and flush interval
+// within cfg from flush latency and arrival rate. The batchSize and
+// interval passed to New are clamped to cfg and used as starting points.
+func WithAdaptive(cfg AdaptiveConfig) Option {
+    return func(b *Batcher) { b.tuner = newTuner(cfg) }
+}
+
+// WithWorkers splits every flush by user_id across n workers that insert
+// their share concurrently, each in its own transaction. All records of a
+// user go to the same worker, so they are still inserted in order.
+func WithWorkers(n int) Option {
+    return func(b *Batcher) { b.workers = n }
+}
+
+// WithCoalescing makes every flush write only the newest record of each user
+// in a namespace c coalesces. The others are counted as written once the
+// newest one is.
+func WithCoalescing(c *Coalescing) Option {
+    return func(b *Batcher) { b.coalescing = c }
+}
+
+func New(d db.Store, batchSize int, interval time.Duration, opts ...Option) *Batcher {
+    b := &Batcher{
         db:        d,
         batchSize: batchSize,
         interval:  interval,
-        queue:     make([]db.Record, 0, batchSize*2),
+        retry:     DefaultRetryPolicy,
+        workers:   1,
+        queue:     make([]item, 0, batchSize*2),
         ch:        make(chan struct{}, 1),
+        space:     make(chan struct{}),
+        spillFuts: make(map[uint64]*Future),
+        dropped:   make(map[string]uint64),
+        lastFlush: time.Now(),
+    }
+    for _, opt := range opts {
+        opt(b)
+    }
+    if b.tuner != nil {
+        b.batchSize = b.tuner.clampSize(batchSize)
+        b.interval = min(max(interval, b.tuner.cfg.MinLinger), b.tuner.cfg.MaxLinger)
     }
+    batchSizeGauge.Set(float64(b.batchSize))
+    lingerGauge.Set(b.interval.Seconds())
+    return b
 }
 
-func (b *Batcher) Enqueue(user, val string, ts int64) {
+// Enqueue queues a record for the next flush. With a WAL configured the
+// record is durable once Enqueue returns nil. The returned Future resolves
+// when the InsertBatch transaction containing the record commits, or when
+// the record is dead-lettered. When the queue is full Enqueue acts on the
+// overflow policy and may return ErrQueueFull.
+func (b *Batcher) Enqueue(user, val string, ts int64) (*Future, error) {
+    rec := db.Record{UserID: user, Value: val, Ts: ts}
+    var data []byte
+    if b.wal != nil {
+        var err error
+        if data, err = json.Marshal(rec); err != nil {
+            return nil, err
+        }
+    }
+
+    fut := newFuture()
     b.mu.Lock()
-    b.queue = append(b.queue, db.Record{UserID: user, Value: val, Ts: ts})
+    spill, err := b.admit(recordSize(rec))
+    if err != nil {
+        b.mu.Unlock()
+        return nil, err
+    }
+    var seq uint64
+    if b.wal != nil {
+        // append under b.mu so queue order matches WAL order
+        var err error
+        if seq, err = b.wal.Append(data); err != nil {
+            b.mu.Unlock()
+            return nil, err
+        }
+    }
+    it := item{rec: rec, seq: seq, fut: fut}
+    if spill {
+        b.spill([]item{it})
+        b.mu.Unlock()
+        return fut, nil
+    }
+    b.queue = append(b.queue, it)
+    b.hold([]item{it})
+    if b.tuner != nil {
+        b.tuner.arrivals++
+    }
     shouldFlush := len(b.queue) >= b.batchSize
     b.mu.Unlock()
     if shouldFlush {
-        select {
-        case b.ch <- struct{}{}:
-        default:
+        b.signal()
+    }
+    return fut, nil
+}
+
+// Drop removes user's records from the queue and returns how many were
+// removed. Their futures resolve with ErrDropped. With a WAL, Drop also
+// logs a marker so that the user's spilled records, and after a restart
+// its records that were never flushed, are dropped when read back. Records
+// of a flush already in progress are not affected.
+func (b *Batcher) Drop(user string) (int, error) {
+    b.mu.Lock()
+    if b.wal != nil {
+        data, err := json.Marshal(walEntry{Record: db.Record{UserID: user}, Drop: true})
+        var seq uint64
+        if err == nil {
+            seq, err = b.wal.Append(data)
+        }
+        if err != nil {
+            b.mu.Unlock()
+            return 0, err
         }
+        b.dropped[user] = seq
     }
+    var dropped []item
+    kept := b.queue[:0]
+    for _, it := range b.queue {
+        if it.rec.UserID == user {
+            dropped = append(dropped, it)
+        } else {
+            kept = append(kept, it)
+        }
+    }
+    // clear the tail so dropped records are not kept alive
+    for i := len(kept); i < len(b.queue); i++ {
+        b.queue[i] = item{}
+    }
+    b.queue = kept
+    b.release(dropped)
+    b.mu.Unlock()
+    resolve(dropped, ErrDropped)
+    return len(dropped), nil
 }
 
+// walEntry is the WAL form of a record or, with Drop set, of a Drop call.
+type walEntry struct {
+    db.Record
+    Drop bool `json:"drop,omitempty"`
+}
+
+func decodeEntry(data []byte) (walEntry, error) {
+    var e walEntry
+    err := json.Unmarshal(data, &e)
+    return e, err
+}
+
+// isDropped reports whether it was read back from the WAL after a Drop of
+// its user, with b.mu held.
+func (b *Batcher) isDropped(it item) bool {
+    seq, ok := b.dropped[it.rec.UserID]
+    return ok && it.seq < seq
+}
+
+// Stats is a snapshot of the queue.
+type Stats struct {
+    // Pending counts records held in memory, including the batch being
+    // flushed.
+    Pending      int
+    PendingBytes int64
+    Spilled      int
+    // LastFlush is when a flush last left nothing to retry. An idle batcher
+    // counts as flushed on every tick, so its age only grows past the flush
+    // interval while records cannot be written.
+    LastFlush time.Time
+}
+
+func (b *Batcher) Stats() Stats {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    s := Stats{Pending: b.pending, PendingBytes: b.pendingBytes, LastFlush: b.lastFlush}
+    if b.spillFrom != 0 {
+        s.Spilled = int(b.spillTo - b.spillFrom + 1)
+    }
+    return s
+}
+
+// Run flushes the queue until ctx is cancelled. It then flushes once more,
+// with retries that no longer watch ctx, and returns. Records that still
+// fail stay in the WAL for the next process.
 func (b *Batcher) Run(ctx context.Context) {
-    ticker := time.NewTicker(b.interval)
-    defer ticker.Stop()
+    b.replay.Do(b.replayWAL)
+
+    timer := time.NewTimer(b.linger())
+    defer timer.Stop()
     for {
         select {
         case <-ctx.Done():
-            b.flush(ctx)
+            b.flush(context.WithoutCancel(ctx))
             return
         case <-b.ch:
-            b.flush(ctx)
-        case <-ticker.C:
-            b.flush(ctx)
+        case <-timer.C:
+        }
+        b.flush(ctx)
+        // the linger counts from the last flush, and may have been retuned
+        if !timer.Stop() {
+            select {
+            case <-timer.C:
+            default:
+            }
+        }
+        timer.Reset(b.linger())
+    }
+}
+
+func (b *Batcher) linger() time.Duration {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.interval
+}
+
+// replayWAL puts records that were accepted but never flushed by a previous
+// process back at the head of the queue. Those beyond the queue limits stay
+// spilled in the WAL.
+func (b *Batcher) replayWAL() {
+    if b.wal == nil {
+        return
+    }
+    var replayed []item
+    err := b.wal.Replay(func(seq uint64, data []byte) error {
+        e, err := decodeEntry(data)
+        if err != nil {
+            log.Printf("wal replay: skipping entry %d: %v", seq, err)
+            return nil
         }
+        if e.Drop {
+            // the user was deleted after these were accepted
+            kept := replayed[:0]
+            for _, it := range replayed {
+                if it.rec.UserID != e.UserID {
+                    kept = append(kept, it)
+                }
+            }
+            replayed = kept
+            return nil
+        }
+        replayed = append(replayed, item{rec: e.Record, seq: seq})
+        return nil
+    })
+    if err != nil {
+        log.Printf("wal replay error: %v", err)
+    }
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    // and so may they have been since this process started
+    kept := replayed[:0]
+    for _, it := range replayed {
+        if !b.isDropped(it) {
+            kept = append(kept, it)
+        }
+    }
+    replayed = kept
+    if len(replayed) == 0 {
+        return
+    }
+    log.Printf("wal replay: recovered %d records", len(replayed))
+    // re-admit everything queued so far behind the replayed records
+    all := append(replayed, b.queue...)
+    b.release(b.queue)
+    b.queue = make([]item, 0, len(all))
+    for i, it := range all {
+        if !b.fits(recordSize(it.rec)) {
+            b.spill(all[i:])
+            log.Printf("wal replay: %d records spilled until the queue has room", len(all)-i)
+            return
+        }
+        b.queue = append(b.queue, it)
+        b.hold(all[i : i+1])
     }
 }
 
 func (b *Batcher) flush(ctx context.Context) {
+    b.refill()
     b.mu.Lock()
     if len(b.queue) == 0 {
+        b.lastFlush = time.Now()
+        if b.tuner != nil {
+            // let the rate decay while idle
+            b.tuner.sample(time.Now())
+            b.setInterval(b.tuner.linger(b.batchSize))
+        }
         b.mu.Unlock()
         return
     }
-    toWrite := make([]db.Record, len(b.queue))
+    toWrite := make([]item, len(b.queue))
     copy(toWrite, b.queue)
     b.queue = b.queue[:0]
     b.mu.Unlock()
-    _ = b.db.InsertBatch(ctx, toWrite)
+
+    start := time.Now()
+    requeue := b.writeParallel(ctx, b.coalesce(toWrite))
+    took := time.Since(start)
+    flushSeconds.Observe(took.Seconds())
+    b.mu.Lock()
+    if b.tuner != nil {
+        b.tuner.sample(time.Now())
+        b.batchSize = b.tuner.adjust(b.batchSize, len(toWrite), took, len(requeue) == 0)
+        batchSizeGauge.Set(float64(b.batchSize))
+        b.setInterval(b.tuner.linger(b.batchSize))
+    }
+    if len(requeue) > 0 {
+        // keep the records (and their WAL entries) for the next flush
+        requeuedTotal.Add(float64(len(requeue)))
+        b.queue = append(requeue, b.queue...)
+    } else {
+        b.lastFlush = time.Now()
+    }
+    b.pending -= len(toWrite) - len(requeue)
+    b.pendingBytes -= itemsSize(toWrite) - itemsSize(requeue)
+    b.updateGauges()
+    b.wake()
+    spilled := b.spillFrom != 0
+    b.mu.Unlock()
+    if spilled && len(requeue) < len(toWrite) {
+        // read the next spilled records back without waiting for the ticker
+        b.signal()
+    }
+    if b.wal == nil {
+        return
+    }
+    // everything below the oldest requeued record is committed or
+    // dead-lettered
+    upTo := toWrite[len(toWrite)-1].seq
+    if len(requeue) > 0 {
+        upTo = requeue[0].seq - 1
+    }
+    if err := b.wal.Truncate(upTo); err != nil {
+        log.Printf("wal truncate error: %v", err)
+    }
+}
+
+// setInterval changes the flush interval, with b.mu held.
+func (b *Batcher) setInterval(d time.Duration) {
+    b.interval = d
+    lingerGauge.Set(d.Seconds())
+}
+
+// writeParallel partitions items by user across the workers and writes the
+// partitions concurrently. The next flush only starts once every partition
+// is done, so requeued records are retried before any newer record of the
+// same user. The returned items are in WAL order, which keeps each user's
+// records in order.
+func (b *Batcher) writeParallel(ctx context.Context, items []item) []item {
+    if b.workers <= 1 || len(items) < 2 {
+        return b.write(ctx, items)
+    }
+    parts := make([][]item, b.workers)
+    for _, it := range items {
+        i := partition(it.rec.UserID, b.workers)
+        parts[i] = append(parts[i], it)
+    }
+    var (
+        wg      sync.WaitGroup
+        mu      sync.Mutex
+        requeue []item
+    )
+    for _, part := range parts {
+        if len(part) == 0 {
+            continue
+        }
+        wg.Add(1)
+        go func(part []item) {
+            defer wg.Done()
+            if r := b.write(ctx, part); len(r) > 0 {
+                mu.Lock()
+                requeue = append(requeue, r...)
+                mu.Unlock()
+            }
+        }(part)
+    }
+    wg.Wait()
+    // a user's records share a partition, so this keeps them in order
+    sort.SliceStable(requeue, func(i, j int) bool { return requeue[i].seq < requeue[j].seq })
+    return requeue
+}
+
+func partition(user string, n int) int {
+    h := fnv.New32a()
+    _, _ = h.Write([]byte(user))
+    return int(h.Sum32() % uint32(n))
+}
+
+// write inserts items with retries. If the batch keeps failing on a data
+// error it is bisected until the offending records are isolated and
+// dead-lettered. It returns the items that hit a transient error and should
+// be retried on a later flush, in queue order.
+func (b *Batcher) write(ctx context.Context, items []item) []item {
+    dropped, err := b.insertWithRetry(ctx, items)
+    if err == nil {
+        flushesTotal.WithLabelValues("ok").Inc()
+        resolveInserted(items, dropped)
+        return nil
+    }
+    flushesTotal.WithLabelValues("error").Inc()
+    if !db.IsPermanent(err) {
+        log.Printf("batch flush of %d records failed: %v", len(items), err)
+        return items
+    }
+    return b.isolate(ctx, items, err)
+}
+
+func (b *Batcher) isolate(ctx context.Context, items []item, cause error) []item {
+    if len(items) == 1 {
+        b.sendToDeadLetter(ctx, items, cause)
+        return nil
+    }
+    mid := len(items) / 2
+    var requeue []item
+    for _, half := range [][]item{items[:mid], items[mid:]} {
+        dropped, err := b.insert(ctx, half)
+        switch {
+        case err == nil:
+            resolveInserted(half, dropped)
+        case db.IsPermanent(err):
+            requeue = append(requeue, b.isolate(ctx, half, err)...)
+        default:
+            requeue = append(requeue, half...)
+        }
+    }
+    return requeue
+}
+
+func (b *Batcher) insertWithRetry(ctx context.Context, items []item) ([]int, error) {
+    attempts := b.retry.MaxAttempts
+    if attempts < 1 {
+        attempts = 1
+    }
+    var err error
+    for attempt := 0; attempt < attempts; attempt++ {
+        if attempt > 0 {
+            retriesTotal.Inc()
+            select {
+            case <-ctx.Done():
+                return nil, err
+            case <-time.After(b.backoff(attempt)):
+            }
+        }
+        var dropped []int
+        if dropped, err = b.insert(ctx, items); err == nil || db.IsPermanent(err) {
+            return dropped, err
+        }
+    }
+    return nil, err
+}
+
+// insert writes items and returns the indexes of those the store dropped as
+// older than their user's tombstone.
+func (b *Batcher) insert(ctx context.Context, items []item) ([]int, error) {
+    recs := make([]db.Record, len(items))
+    for i, it := range items {
+        recs[i] = it.rec
+    }
+    return b.db.InsertBatch(ctx, recs)
+}
+
+// backoff returns the delay before the given retry: exponential with equal
+// jitter, capped at MaxDelay.
+func (b *Batcher) backoff(attempt int) time.Duration {
+    d := b.retry.BaseDelay << (attempt - 1)
+    if d <= 0 || (b.retry.MaxDelay > 0 && d > b.retry.MaxDelay) {
+        d = b.retry.MaxDelay
+    }
+    if d <= 0 {
+        return 0
+    }
+    return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func (b *Batcher) sendToDeadLetter(ctx context.Context, items []item, cause error) {
+    resolve(items, &DeadLetterError{Cause: cause})
+    recs := make([]db.Record, len(items))
+    for i, it := range items {
+        recs[i] = it.rec
+    }
+    deadLetteredTotal.Add(float64(len(recs)))
+    if b.deadLetter == nil {
+        log.Printf("dropping %d records after permanent failure: %v", len(recs), cause)
+        return
+    }
+    if err := b.deadLetter.Put(ctx, recs, cause); err != nil {
+        log.Printf("dead-letter write of %d records failed, dropping: %v (cause: %v)", len(recs), err, cause)
+    }
 }
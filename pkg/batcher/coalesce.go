@@ -0,0 +1,102 @@
+package batcher
+
+import (
+    "fmt"
+
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/promauto"
+    "github.com/yourname/dsproxy/pkg/prefix"
+)
+
+var coalescedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+    Name: "dsproxy_batch_coalesced_records_total",
+    Help: "Records not written because a newer record of the same user was in the batch, by namespace.",
+}, []string{"namespace"})
+
+// CoalescePolicy says whether batches keep only the newest record of each
+// user whose user_id starts with Prefix (the namespace).
+type CoalescePolicy struct {
+    Prefix string
+    Latest bool
+}
+
+// namespace is the metric label for pol.
+func (pol CoalescePolicy) namespace() string {
+    if pol.Prefix == "" {
+        return "*"
+    }
+    return pol.Prefix
+}
+
+// Coalescing resolves the CoalescePolicy for a user by longest matching
+// prefix. Users no policy matches are not coalesced.
+type Coalescing struct {
+    *prefix.Table[CoalescePolicy]
+}
+
+// NewCoalescing returns a resolver for ps. A policy with an empty prefix
+// sets the default.
+func NewCoalescing(ps ...CoalescePolicy) *Coalescing {
+    return &Coalescing{prefix.New(CoalescePolicy{}, func(pol CoalescePolicy) string { return pol.Prefix }, ps...)}
+}
+
+// ParseCoalescing parses a comma-separated list of prefix=mode entries,
+// where mode is "latest" (keep only the newest record per user and batch)
+// or "all". The prefix "*" sets the default, e.g.
+//
+//  *=latest,audit:=all
+func ParseCoalescing(s string) ([]CoalescePolicy, error) {
+    return prefix.ParseList(s, "coalesce policy", func(p, mode string) (CoalescePolicy, error) {
+        switch mode {
+        case "latest":
+            return CoalescePolicy{Prefix: p, Latest: true}, nil
+        case "all":
+            return CoalescePolicy{Prefix: p}, nil
+        }
+        return CoalescePolicy{}, fmt.Errorf("invalid mode %q", mode)
+    })
+}
+
+// coalesce keeps, for every user whose namespace is coalesced, only the
+// record with the highest ts; of equal ts the later one wins. The futures of
+// the other records resolve with the kept one. The result stays in queue
+// order.
+func (b *Batcher) coalesce(items []item) []item {
+    if b.coalescing == nil {
+        return items
+    }
+    winner := make(map[string]int)
+    for i, it := range items {
+        if !b.coalescing.For(it.rec.UserID).Latest {
+            continue
+        }
+        if w, ok := winner[it.rec.UserID]; !ok || it.rec.Ts >= items[w].rec.Ts {
+            winner[it.rec.UserID] = i
+        }
+    }
+    out := make([]item, 0, len(items))
+    pos := make(map[string]int, len(winner))
+    for i, it := range items {
+        if w, ok := winner[it.rec.UserID]; !ok || w == i {
+            if ok {
+                pos[it.rec.UserID] = len(out)
+            }
+            out = append(out, it)
+        }
+    }
+    if len(out) == len(items) {
+        return items
+    }
+    for i, it := range items {
+        if w, ok := winner[it.rec.UserID]; !ok || w == i {
+            continue
+        }
+        kept := &out[pos[it.rec.UserID]]
+        if it.fut != nil {
+            kept.merged = append(kept.merged, it.fut)
+        }
+        kept.merged = append(kept.merged, it.merged...)
+        coalescedTotal.WithLabelValues(b.coalescing.For(it.rec.UserID).namespace()).Inc()
+    }
+    return out
+}
@@ -0,0 +1,91 @@
+package batcher
+
+import (
+    "context"
+    "errors"
+)
+
+// ErrDropped is the Future result for a record removed by Drop before it
+// was flushed, or discarded by the store because its user was deleted with
+// a newer tombstone.
+var ErrDropped = errors.New("batcher: record dropped")
+
+// ErrLost is the Future result for a spilled record that could not be read
+// back from the WAL.
+var ErrLost = errors.New("batcher: spilled record lost")
+
+// Future is the outcome of a single enqueued record.
+type Future struct {
+    done chan struct{}
+    err  error
+}
+
+func newFuture() *Future {
+    return &Future{done: make(chan struct{})}
+}
+
+// Done is closed once the record has been committed or has failed for good.
+func (f *Future) Done() <-chan struct{} {
+    return f.done
+}
+
+// Wait blocks until the record's batch commits (nil), the record fails
+// permanently (*DeadLetterError), is dropped (ErrDropped), is lost from the
+// WAL while spilled (ErrLost) or ctx ends
+// (ctx.Err()). A transient flush failure does not resolve the future; the
+// record stays queued.
+func (f *Future) Wait(ctx context.Context) error {
+    select {
+    case <-f.done:
+        return f.err
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
+func (f *Future) resolve(err error) {
+    f.err = err
+    close(f.done)
+}
+
+func resolve(items []item, err error) {
+    for _, it := range items {
+        if it.fut != nil {
+            it.fut.resolve(err)
+        }
+        for _, f := range it.merged {
+            f.resolve(err)
+        }
+    }
+}
+
+// resolveInserted resolves the futures of a committed batch: the items at
+// the dropped indexes with ErrDropped, the others with nil.
+func resolveInserted(items []item, dropped []int) {
+    if len(dropped) == 0 {
+        resolve(items, nil)
+        return
+    }
+    for i := range items {
+        var err error
+        if len(dropped) > 0 && dropped[0] == i {
+            err = ErrDropped
+            dropped = dropped[1:]
+        }
+        resolve(items[i:i+1], err)
+    }
+}
+
+// DeadLetterError is the Future result for a record that failed with a
+// permanent error and was moved to the dead-letter sink.
+type DeadLetterError struct {
+    Cause error
+}
+
+func (e *DeadLetterError) Error() string {
+    return "record dead-lettered: " + e.Cause.Error()
+}
+
+func (e *DeadLetterError) Unwrap() error {
+    return e.Cause
+}
@@ -0,0 +1,292 @@
+package batcher
+
+import (
+    "errors"
+    "fmt"
+    "log"
+    "strings"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/promauto"
+    "github.com/yourname/dsproxy/pkg/db"
+)
+
+var (
+    queueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+        Name: "dsproxy_batch_queue_depth",
+        Help: "Records held in memory that are not yet written, including those being flushed.",
+    })
+    queueBytes = promauto.NewGauge(prometheus.GaugeOpts{
+        Name: "dsproxy_batch_queue_bytes",
+        Help: "Approximate size of the records counted by dsproxy_batch_queue_depth.",
+    })
+    spilledRecords = promauto.NewGauge(prometheus.GaugeOpts{
+        Name: "dsproxy_batch_spilled_records",
+        Help: "Records kept only in the WAL until the queue has room for them.",
+    })
+    overflowsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+        Name: "dsproxy_batch_queue_overflows_total",
+        Help: "Enqueues that found the queue full, by action (blocked, rejected, spilled).",
+    }, []string{"action"})
+)
+
+// ErrQueueFull is returned by Enqueue when the queue is at its limits and
+// the overflow policy does not let the record in.
+var ErrQueueFull = errors.New("batcher: queue full")
+
+// OverflowPolicy says what Enqueue does when the queue is full.
+type OverflowPolicy int
+
+const (
+    // OverflowBlock waits up to QueueLimits.BlockTimeout for room, then
+    // fails with ErrQueueFull.
+    OverflowBlock OverflowPolicy = iota
+    // OverflowReject fails with ErrQueueFull right away.
+    OverflowReject
+    // OverflowSpill keeps records that do not fit only in the WAL and reads
+    // them back as the queue drains. Without a WAL it behaves like
+    // OverflowReject.
+    OverflowSpill
+)
+
+// ParseOverflowPolicy maps "block", "reject" and "spill" to an
+// OverflowPolicy.
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+    switch strings.ToLower(s) {
+    case "", "block":
+        return OverflowBlock, nil
+    case "reject":
+        return OverflowReject, nil
+    case "spill":
+        return OverflowSpill, nil
+    }
+    return 0, fmt.Errorf("batcher: unknown overflow policy %q", s)
+}
+
+// QueueLimits bounds the records held in memory: accepted by Enqueue but not
+// yet committed, dead-lettered or dropped. Zero means no limit.
+type QueueLimits struct {
+    MaxRecords   int
+    MaxBytes     int64
+    Policy       OverflowPolicy
+    BlockTimeout time.Duration
+}
+
+// allows reports whether a record of size bytes fits next to pending
+// records of pendingBytes. A lone record always fits, however large.
+func (l QueueLimits) allows(pending int, pendingBytes, size int64) bool {
+    if pending == 0 {
+        return true
+    }
+    return (l.MaxRecords <= 0 || pending < l.MaxRecords) &&
+        (l.MaxBytes <= 0 || pendingBytes+size <= l.MaxBytes)
+}
+
+// recordOverhead approximates the memory of a queued item beyond its
+// strings.
+const recordOverhead = 64
+
+func recordSize(rec db.Record) int64 {
+    return int64(len(rec.UserID) + len(rec.Value) + recordOverhead)
+}
+
+func itemsSize(items []item) int64 {
+    var n int64
+    for _, it := range items {
+        n += recordSize(it.rec)
+    }
+    return n
+}
+
+// fits reports, with b.mu held, whether a record may join the queue.
+// While records are spilled nothing may, so that the queue stays in WAL
+// order.
+func (b *Batcher) fits(size int64) bool {
+    return b.spillFrom == 0 && b.limits.allows(b.pending, b.pendingBytes, size)
+}
+
+// admit decides, with b.mu held, whether a record of size bytes joins the
+// queue (nil), goes to the WAL only (spill) or is refused (ErrQueueFull).
+// Under OverflowBlock it waits for room, releasing b.mu meanwhile.
+func (b *Batcher) admit(size int64) (spill bool, err error) {
+    if b.fits(size) {
+        return false, nil
+    }
+    switch {
+    case b.limits.Policy == OverflowSpill && b.wal != nil:
+        overflowsTotal.WithLabelValues("spilled").Inc()
+        return true, nil
+    case b.limits.Policy == OverflowBlock && b.limits.BlockTimeout > 0:
+        overflowsTotal.WithLabelValues("blocked").Inc()
+        timer := time.NewTimer(b.limits.BlockTimeout)
+        defer timer.Stop()
+        for !b.fits(size) {
+            space := b.space
+            b.mu.Unlock()
+            select {
+            case <-space:
+                b.mu.Lock()
+            case <-timer.C:
+                b.mu.Lock()
+                if b.fits(size) {
+                    return false, nil
+                }
+                overflowsTotal.WithLabelValues("rejected").Inc()
+                return false, ErrQueueFull
+            }
+        }
+        return false, nil
+    }
+    overflowsTotal.WithLabelValues("rejected").Inc()
+    return false, ErrQueueFull
+}
+
+// hold counts items as pending, with b.mu held.
+func (b *Batcher) hold(items []item) {
+    b.pending += len(items)
+    b.pendingBytes += itemsSize(items)
+    b.updateGauges()
+}
+
+// release stops counting items as pending and wakes blocked producers,
+// with b.mu held.
+func (b *Batcher) release(items []item) {
+    if len(items) == 0 {
+        return
+    }
+    b.pending -= len(items)
+    b.pendingBytes -= itemsSize(items)
+    b.updateGauges()
+    b.wake()
+}
+
+func (b *Batcher) wake() {
+    close(b.space)
+    b.space = make(chan struct{})
+}
+
+// spill keeps items only in the WAL, with b.mu held. items must be
+// adjacent to the spilled range in WAL order, either side.
+func (b *Batcher) spill(items []item) {
+    if len(items) == 0 {
+        return
+    }
+    for _, it := range items {
+        if it.fut != nil {
+            b.spillFuts[it.seq] = it.fut
+        }
+    }
+    first, last := items[0].seq, items[len(items)-1].seq
+    if b.spillFrom == 0 || first < b.spillFrom {
+        b.spillFrom = first
+    }
+    if last > b.spillTo {
+        b.spillTo = last
+    }
+    b.updateGauges()
+}
+
+func (b *Batcher) updateGauges() {
+    queueDepth.Set(float64(b.pending))
+    queueBytes.Set(float64(b.pendingBytes))
+    if b.spillFrom == 0 {
+        spilledRecords.Set(0)
+    } else {
+        spilledRecords.Set(float64(b.spillTo - b.spillFrom + 1))
+    }
+}
+
+// refill reads spilled records back from the WAL while they fit.
+func (b *Batcher) refill() {
+    b.mu.Lock()
+    from, to := b.spillFrom, b.spillTo
+    pending, pendingBytes := b.pending, b.pendingBytes
+    if from == 0 {
+        // nothing is left to read back; replay ran before the first refill
+        clear(b.dropped)
+    }
+    b.mu.Unlock()
+    if from == 0 {
+        return
+    }
+
+    var loaded []item
+    next := from
+    err := b.wal.Read(from, to+1, func(seq uint64, data []byte) error {
+        e, err := decodeEntry(data)
+        if err != nil {
+            log.Printf("wal refill: skipping entry %d: %v", seq, err)
+            next = seq + 1
+            return nil
+        }
+        if e.Drop {
+            next = seq + 1
+            return nil
+        }
+        rec := e.Record
+        size := recordSize(rec)
+        if !b.limits.allows(pending, pendingBytes, size) {
+            return ErrQueueFull
+        }
+        pending++
+        pendingBytes += size
+        loaded = append(loaded, item{rec: rec, seq: seq})
+        next = seq + 1
+        return nil
+    })
+    switch {
+    case err == nil:
+        // entries the log no longer has cannot be read back later either
+        next = to + 1
+    case !errors.Is(err, ErrQueueFull):
+        log.Printf("wal refill error: %v", err)
+    }
+
+    b.mu.Lock()
+    var dropped []item
+    kept := loaded[:0]
+    for _, it := range loaded {
+        it.fut = b.spillFuts[it.seq]
+        delete(b.spillFuts, it.seq)
+        if b.isDropped(it) {
+            dropped = append(dropped, it)
+        } else {
+            kept = append(kept, it)
+        }
+    }
+    loaded = kept
+    // what is left below next was skipped or is gone from the log
+    var lost []*Future
+    for seq := from; seq < next; seq++ {
+        if fut, ok := b.spillFuts[seq]; ok {
+            lost = append(lost, fut)
+            delete(b.spillFuts, seq)
+        }
+    }
+    b.queue = append(b.queue, loaded...)
+    b.hold(loaded)
+    b.spillFrom = next
+    if next > b.spillTo {
+        b.spillFrom, b.spillTo = 0, 0
+        clear(b.dropped)
+        b.updateGauges()
+        b.wake()
+    }
+    shouldFlush := len(b.queue) >= b.batchSize
+    b.mu.Unlock()
+    for _, fut := range lost {
+        fut.resolve(ErrLost)
+    }
+    resolve(dropped, ErrDropped)
+    if shouldFlush {
+        b.signal()
+    }
+}
+
+func (b *Batcher) signal() {
+    select {
+    case b.ch <- struct{}{}:
+    default:
+    }
+}
@@ -2,17 +2,131 @@ package cache
 
 import (
     "context"
+    "errors"
+    "fmt"
+    "strconv"
+    "strings"
     "time"
     "log"
 
     "github.com/go-redis/redis/v8"
 )
 
-type Cache struct {
-    client *redis.Client
+// Cache is a key/value cache in front of the store. Every value carries the
+// timestamp of the write that produced it so that a late write with an
+// older ts cannot replace a newer value (last write wins by ts, ties go to
+// the later arrival, matching db.Store.GetLatest).
+type Cache interface {
+    // Get returns ErrMiss when key is not cached.
+    Get(ctx context.Context, key string) (string, error)
+    GetEntry(ctx context.Context, key string) (Entry, error)
+    // GetMany returns the cached entries, negative ones included, for the
+    // keys that are cached; missing keys are absent from the map.
+    GetMany(ctx context.Context, keys []string) (map[string]Entry, error)
+    // Set stores val unconditionally, without a timestamp.
+    Set(ctx context.Context, key, val string) error
+    // SetIfNewer stores e unless the cached entry has a higher ts. It
+    // always replaces a not-found marker set by SetMissing.
+    SetIfNewer(ctx context.Context, key string, e Entry) (SetResult, error)
+    // SetManyIfNewer applies SetIfNewer to each item in order, in as few
+    // round trips as the backend allows.
+    SetManyIfNewer(ctx context.Context, items []KeyEntry) ([]SetResult, error)
+    // SetMissing caches the fact that key does not exist in the store for
+    // ttl, unless something is already cached for key.
+    SetMissing(ctx context.Context, key string, ttl time.Duration) error
+    // SetManyMissing applies SetMissing to each key, in as few round trips
+    // as the backend allows.
+    SetManyMissing(ctx context.Context, keys []string, ttl time.Duration) error
+    // SetDeleted replaces key with a negative entry stamped ts, which
+    // SetIfNewer only replaces with an entry at least as new. Unlike Delete
+    // it keeps a concurrent refill of an older value out.
+    SetDeleted(ctx context.Context, key string, ts int64) error
+    Delete(ctx context.Context, keys ...string) error
+    // Ping checks that the backend is reachable.
+    Ping(ctx context.Context) error
+    Close() error
 }
 
-func New(addr string) *Cache {
+type Entry struct {
+    Value string
+    Ts    int64
+    // Missing marks a negative entry: the store had nothing for the key.
+    // A non-zero Ts on a negative entry is the ts of a deletion.
+    Missing bool
+}
+
+// KeyEntry is one item of a SetManyIfNewer call.
+type KeyEntry struct {
+    Key   string
+    Entry Entry
+}
+
+// SetResult is the outcome of SetIfNewer.
+type SetResult int
+
+const (
+    // Stale means the cache already held a newer entry and was not changed.
+    Stale SetResult = iota
+    // Updated means an older entry was replaced.
+    Updated
+    // Created means nothing was cached for the key; the caller cannot tell
+    // from the cache alone whether the store holds something newer.
+    Created
+)
+
+func (r SetResult) Applied() bool {
+    return r != Stale
+}
+
+var ErrMiss = errors.New("cache: miss")
+
+// DefaultTTL applies to keys not covered by a Policy.
+const DefaultTTL = 5 * time.Minute
+
+// setIfNewerScript stores value and ts in a hash unless the hash holds a
+// higher ts, clearing any not-found marker (nf). Returns 0 (stale),
+// 1 (updated) or 2 (created).
+var setIfNewerScript = redis.NewScript(`
+local cur = redis.call('HGET', KEYS[1], 'ts')
+if cur and tonumber(cur) > tonumber(ARGV[2]) then
+    return 0
+end
+redis.call('HSET', KEYS[1], 'v', ARGV[1], 'ts', ARGV[2])
+redis.call('HDEL', KEYS[1], 'nf')
+if tonumber(ARGV[3]) > 0 then
+    redis.call('PEXPIRE', KEYS[1], ARGV[3])
+else
+    redis.call('PERSIST', KEYS[1])
+end
+if cur then
+    return 1
+end
+return 2
+`)
+
+// setMissingScript stores a not-found marker unless the key exists.
+var setMissingScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+    return 0
+end
+redis.call('HSET', KEYS[1], 'nf', 1)
+redis.call('PEXPIRE', KEYS[1], ARGV[1])
+return 1
+`)
+
+// Redis is a Cache backed by a Redis server.
+type Redis struct {
+    client   *redis.Client
+    policies *Policies
+}
+
+var _ Cache = (*Redis)(nil)
+
+func New(addr string, opts ...Option) *Redis {
+    cfg := config{policies: NewPolicies(Policy{TTL: DefaultTTL})}
+    for _, opt := range opts {
+        opt(&cfg)
+    }
     opt := &redis.Options{
         Addr: addr,
     }
@@ -21,13 +135,213 @@ func New(addr string) *Cache {
     if err := client.Ping(context.Background()).Err(); err != nil {
         log.Printf("redis ping error: %v", err)
     }
-    return &Cache{client: client}
+    return &Redis{client: client, policies: cfg.policies}
+}
+
+// Values are stored as hashes with fields v (value) and ts.
+func (c *Redis) Set(ctx context.Context, key, val string) error {
+    pipe := c.client.TxPipeline()
+    pipe.HSet(ctx, key, "v", val, "ts", 0)
+    pipe.HDel(ctx, key, "nf")
+    if ttl := c.policies.For(key).ttl(); ttl > 0 {
+        pipe.PExpire(ctx, key, ttl)
+    } else {
+        pipe.Persist(ctx, key)
+    }
+    _, err := pipe.Exec(ctx)
+    return err
+}
+
+func (c *Redis) Get(ctx context.Context, key string) (string, error) {
+    e, err := c.GetEntry(ctx, key)
+    if err == nil && e.Missing {
+        return "", ErrMiss
+    }
+    return e.Value, err
+}
+
+func (c *Redis) GetEntry(ctx context.Context, key string) (Entry, error) {
+    vals, err := c.client.HMGet(ctx, key, "v", "ts", "nf").Result()
+    if err != nil {
+        return Entry{}, err
+    }
+    e, err := parseEntry(vals)
+    if err != nil {
+        return Entry{}, err
+    }
+    if pol := c.policies.For(key); pol.Sliding && !e.Missing {
+        _ = c.client.PExpire(ctx, key, pol.TTL).Err()
+    }
+    return e, nil
+}
+
+// GetMany reads all keys in one pipeline.
+func (c *Redis) GetMany(ctx context.Context, keys []string) (map[string]Entry, error) {
+    pipe := c.client.Pipeline()
+    cmds := make([]*redis.SliceCmd, len(keys))
+    for i, key := range keys {
+        cmds[i] = pipe.HMGet(ctx, key, "v", "ts", "nf")
+    }
+    if len(keys) > 0 {
+        if _, err := pipe.Exec(ctx); err != nil {
+            return nil, err
+        }
+    }
+    out := make(map[string]Entry, len(keys))
+    slide := c.client.Pipeline()
+    for i, key := range keys {
+        e, err := parseEntry(cmds[i].Val())
+        if err != nil {
+            continue
+        }
+        out[key] = e
+        if pol := c.policies.For(key); pol.Sliding && !e.Missing {
+            slide.PExpire(ctx, key, pol.TTL)
+        }
+    }
+    if slide.Len() > 0 {
+        _, _ = slide.Exec(ctx)
+    }
+    return out, nil
+}
+
+// slide pushes out the expiry of those keys whose policy is sliding, in
+// one round trip.
+func (c *Redis) slide(ctx context.Context, keys []string) error {
+    pipe := c.client.Pipeline()
+    for _, key := range keys {
+        if pol := c.policies.For(key); pol.Sliding {
+            pipe.PExpire(ctx, key, pol.TTL)
+        }
+    }
+    if pipe.Len() == 0 {
+        return nil
+    }
+    _, err := pipe.Exec(ctx)
+    return err
+}
+
+func (c *Redis) SetIfNewer(ctx context.Context, key string, e Entry) (SetResult, error) {
+    n, err := setIfNewerScript.Run(ctx, c.client, []string{key},
+        e.Value, e.Ts, c.policies.For(key).ttl().Milliseconds()).Int()
+    if err != nil {
+        return Stale, err
+    }
+    return SetResult(n), nil
+}
+
+// SetManyIfNewer runs setIfNewerScript for every item in one pipeline.
+func (c *Redis) SetManyIfNewer(ctx context.Context, items []KeyEntry) ([]SetResult, error) {
+    if len(items) == 0 {
+        return nil, nil
+    }
+    cmds, err := c.pipelineSetIfNewer(ctx, items)
+    if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+        // nothing ran; load the script and try once more
+        if err := setIfNewerScript.Load(ctx, c.client).Err(); err != nil {
+            return nil, err
+        }
+        cmds, err = c.pipelineSetIfNewer(ctx, items)
+    }
+    if err != nil {
+        return nil, err
+    }
+    res := make([]SetResult, len(cmds))
+    for i, cmd := range cmds {
+        n, err := cmd.Int()
+        if err != nil {
+            return nil, err
+        }
+        res[i] = SetResult(n)
+    }
+    return res, nil
 }
 
-func (c *Cache) Set(ctx context.Context, key, val string) error {
-    return c.client.Set(ctx, key, val, 5*time.Minute).Err()
+func (c *Redis) pipelineSetIfNewer(ctx context.Context, items []KeyEntry) ([]*redis.Cmd, error) {
+    pipe := c.client.Pipeline()
+    cmds := make([]*redis.Cmd, len(items))
+    for i, it := range items {
+        cmds[i] = setIfNewerScript.EvalSha(ctx, pipe, []string{it.Key},
+            it.Entry.Value, it.Entry.Ts, c.policies.For(it.Key).ttl().Milliseconds())
+    }
+    _, err := pipe.Exec(ctx)
+    return cmds, err
 }
 
-func (c *Cache) Get(ctx context.Context, key string) (string, error) {
-    return c.client.Get(ctx, key).Result()
+func (c *Redis) SetMissing(ctx context.Context, key string, ttl time.Duration) error {
+    return setMissingScript.Run(ctx, c.client, []string{key}, ttl.Milliseconds()).Err()
+}
+
+func (c *Redis) SetManyMissing(ctx context.Context, keys []string, ttl time.Duration) error {
+    if len(keys) == 0 {
+        return nil
+    }
+    err := c.pipelineSetMissing(ctx, keys, ttl)
+    if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+        // nothing ran; load the script and try once more
+        if err := setMissingScript.Load(ctx, c.client).Err(); err != nil {
+            return err
+        }
+        err = c.pipelineSetMissing(ctx, keys, ttl)
+    }
+    return err
+}
+
+func (c *Redis) pipelineSetMissing(ctx context.Context, keys []string, ttl time.Duration) error {
+    pipe := c.client.Pipeline()
+    for _, key := range keys {
+        setMissingScript.EvalSha(ctx, pipe, []string{key}, ttl.Milliseconds())
+    }
+    _, err := pipe.Exec(ctx)
+    return err
+}
+
+func (c *Redis) SetDeleted(ctx context.Context, key string, ts int64) error {
+    pipe := c.client.TxPipeline()
+    pipe.Del(ctx, key)
+    pipe.HSet(ctx, key, "nf", 1, "ts", ts)
+    if ttl := c.policies.For(key).ttl(); ttl > 0 {
+        pipe.PExpire(ctx, key, ttl)
+    }
+    _, err := pipe.Exec(ctx)
+    return err
+}
+
+func (c *Redis) Delete(ctx context.Context, keys ...string) error {
+    if len(keys) == 0 {
+        return nil
+    }
+    return c.client.Del(ctx, keys...).Err()
+}
+
+func (c *Redis) Ping(ctx context.Context) error {
+    return c.client.Ping(ctx).Err()
+}
+
+func (c *Redis) Close() error {
+    return c.client.Close()
+}
+
+// parseEntry converts an HMGET v ts nf reply into an Entry.
+func parseEntry(vals []interface{}) (Entry, error) {
+    if len(vals) != 3 {
+        return Entry{}, ErrMiss
+    }
+    var e Entry
+    switch {
+    case vals[2] != nil:
+        e.Missing = true
+    case vals[0] == nil:
+        return Entry{}, ErrMiss
+    default:
+        e.Value = fmt.Sprint(vals[0])
+    }
+    if vals[1] != nil {
+        ts, err := strconv.ParseInt(fmt.Sprint(vals[1]), 10, 64)
+        if err != nil {
+            return Entry{}, err
+        }
+        e.Ts = ts
+    }
+    return e, nil
 }
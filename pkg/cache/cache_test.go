@@ -3,6 +3,7 @@ package cache
 import (
 	"context"
 	"testing"
+	"time"
 )
 
 func TestCache_SetAndGet(t *testing.T) {
@@ -182,3 +183,433 @@ func TestCache_New(t *testing.T) {
 		})
 	}
 }
+
+func TestLRU_SetGetDelete(t *testing.T) {
+	c := NewLRU(10, 0)
+	ctx := context.Background()
+
+	if _, err := c.Get(ctx, "missing"); err != ErrMiss {
+		t.Errorf("Get() on missing key error = %v, want ErrMiss", err)
+	}
+	if err := c.Set(ctx, "k", "v1"); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	c.Set(ctx, "k", "v2")
+	if got, err := c.Get(ctx, "k"); err != nil || got != "v2" {
+		t.Errorf("Get() = %q, %v, want v2", got, err)
+	}
+	c.Delete(ctx, "k")
+	if _, err := c.Get(ctx, "k"); err != ErrMiss {
+		t.Errorf("Get() after Delete error = %v, want ErrMiss", err)
+	}
+}
+
+func TestLRU_Eviction(t *testing.T) {
+	c := NewLRU(2, 0)
+	ctx := context.Background()
+
+	c.Set(ctx, "a", "1")
+	c.Set(ctx, "b", "2")
+	// touch a so b becomes least recently used
+	c.Get(ctx, "a")
+	c.Set(ctx, "c", "3")
+
+	tests := []struct {
+		key     string
+		wantErr error
+	}{
+		{"a", nil},
+		{"b", ErrMiss},
+		{"c", nil},
+	}
+	for _, tt := range tests {
+		if _, err := c.Get(ctx, tt.key); err != tt.wantErr {
+			t.Errorf("Get(%s) error = %v, want %v", tt.key, err, tt.wantErr)
+		}
+	}
+	if c.Len() != 2 {
+		t.Errorf("Len() = %d, want 2", c.Len())
+	}
+}
+
+func TestLRU_Expiration(t *testing.T) {
+	c := NewLRU(10, 20*time.Millisecond)
+	ctx := context.Background()
+
+	c.Set(ctx, "k", "v")
+	time.Sleep(40 * time.Millisecond)
+	if _, err := c.Get(ctx, "k"); err != ErrMiss {
+		t.Errorf("Get() after ttl error = %v, want ErrMiss", err)
+	}
+}
+
+func TestTiered_CrossInstanceInvalidation(t *testing.T) {
+	ctx := context.Background()
+	if err := New("localhost:6379").client.Ping(ctx).Err(); err != nil {
+		t.Skip("Skipping test: redis not available")
+	}
+
+	a := NewTiered(NewLRU(10, time.Minute), New("localhost:6379"))
+	defer a.Close()
+	b := NewTiered(NewLRU(10, time.Minute), New("localhost:6379"))
+	defer b.Close()
+
+	key := "tiered_test_key"
+	a.Set(ctx, key, "v1")
+	// b now holds v1 in its L1
+	if got, _ := b.Get(ctx, key); got != "v1" {
+		t.Fatalf("b.Get() = %q, want v1", got)
+	}
+
+	a.Set(ctx, key, "v2")
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if got, _ := b.Get(ctx, key); got == "v2" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("b kept serving a stale L1 entry after a.Set()")
+}
+
+func TestTiered_SlidesOnL1Hit(t *testing.T) {
+	ctx := context.Background()
+	if err := New("localhost:6379").client.Ping(ctx).Err(); err != nil {
+		t.Skip("Skipping test: redis not available")
+	}
+
+	l2 := New("localhost:6379", WithPolicies(NewPolicies(Policy{TTL: time.Minute},
+		Policy{Prefix: "slide_", TTL: 3 * time.Second, Sliding: true})))
+	c := NewTiered(NewLRU(10, time.Minute), l2)
+	defer c.Close()
+
+	key := "slide_tiered_key"
+	c.Set(ctx, key, "v")
+	// keep reading from L1 past the Redis TTL
+	for i := 0; i < 5; i++ {
+		if got, _ := c.Get(ctx, key); got != "v" {
+			t.Fatalf("Get() = %q, want v", got)
+		}
+		time.Sleep(SlideInterval)
+	}
+	if _, err := l2.Get(ctx, key); err != nil {
+		t.Errorf("Redis entry expired despite L1 hits: %v", err)
+	}
+}
+
+func TestCache_SetIfNewer(t *testing.T) {
+	ctx := context.Background()
+	backends := map[string]Cache{"lru": NewLRU(10, 0)}
+	if r := New("localhost:6379"); r.client.Ping(ctx).Err() == nil {
+		backends["redis"] = r
+	}
+
+	for name, c := range backends {
+		t.Run(name, func(t *testing.T) {
+			key := "lww_test_key"
+			c.Delete(ctx, key)
+
+			steps := []struct {
+				entry     Entry
+				want      SetResult
+				wantValue string
+			}{
+				{Entry{Value: "v200", Ts: 200}, Created, "v200"},
+				{Entry{Value: "v100", Ts: 100}, Stale, "v200"},
+				{Entry{Value: "v300", Ts: 300}, Updated, "v300"},
+				{Entry{Value: "v300b", Ts: 300}, Updated, "v300b"},
+			}
+			for _, s := range steps {
+				got, err := c.SetIfNewer(ctx, key, s.entry)
+				if err != nil {
+					t.Fatalf("SetIfNewer(%+v) error = %v", s.entry, err)
+				}
+				if got != s.want {
+					t.Errorf("SetIfNewer(%+v) = %v, want %v", s.entry, got, s.want)
+				}
+				e, err := c.GetEntry(ctx, key)
+				if err != nil || e.Value != s.wantValue {
+					t.Errorf("GetEntry() after %+v = %+v, %v, want %s", s.entry, e, err, s.wantValue)
+				}
+			}
+		})
+	}
+}
+
+func TestCache_SetManyIfNewer(t *testing.T) {
+	ctx := context.Background()
+	backends := map[string]Cache{"lru": NewLRU(10, 0)}
+	if r := New("localhost:6379"); r.client.Ping(ctx).Err() == nil {
+		backends["redis"] = r
+	}
+
+	for name, c := range backends {
+		t.Run(name, func(t *testing.T) {
+			c.Delete(ctx, "many_a", "many_b")
+			c.SetIfNewer(ctx, "many_b", Entry{Value: "b500", Ts: 500})
+
+			items := []KeyEntry{
+				{"many_a", Entry{Value: "a100", Ts: 100}},
+				{"many_b", Entry{Value: "b100", Ts: 100}},
+				{"many_a", Entry{Value: "a200", Ts: 200}},
+				{"many_a", Entry{Value: "a150", Ts: 150}},
+			}
+			got, err := c.SetManyIfNewer(ctx, items)
+			if err != nil {
+				t.Fatalf("SetManyIfNewer() error = %v", err)
+			}
+			want := []SetResult{Created, Stale, Updated, Stale}
+			for i := range want {
+				if got[i] != want[i] {
+					t.Errorf("SetManyIfNewer() result %d = %v, want %v", i, got[i], want[i])
+				}
+			}
+			for key, wantValue := range map[string]string{"many_a": "a200", "many_b": "b500"} {
+				if v, _ := c.Get(ctx, key); v != wantValue {
+					t.Errorf("Get(%s) = %q, want %q", key, v, wantValue)
+				}
+			}
+		})
+	}
+}
+
+func TestCache_GetMany(t *testing.T) {
+	ctx := context.Background()
+	backends := map[string]Cache{"lru": NewLRU(10, 0)}
+	if r := New("localhost:6379"); r.client.Ping(ctx).Err() == nil {
+		backends["redis"] = r
+	}
+
+	for name, c := range backends {
+		t.Run(name, func(t *testing.T) {
+			c.Delete(ctx, "getmany_a", "getmany_nf", "getmany_none")
+			c.SetIfNewer(ctx, "getmany_a", Entry{Value: "a", Ts: 7})
+			c.SetMissing(ctx, "getmany_nf", time.Minute)
+
+			got, err := c.GetMany(ctx, []string{"getmany_a", "getmany_nf", "getmany_none"})
+			if err != nil {
+				t.Fatalf("GetMany() error = %v", err)
+			}
+			if e := got["getmany_a"]; e.Value != "a" || e.Ts != 7 {
+				t.Errorf("GetMany()[a] = %+v, want a@7", e)
+			}
+			if e, ok := got["getmany_nf"]; !ok || !e.Missing {
+				t.Errorf("GetMany()[nf] = %+v, %v, want a negative entry", e, ok)
+			}
+			if _, ok := got["getmany_none"]; ok {
+				t.Error("GetMany() returned an entry for an uncached key")
+			}
+		})
+	}
+}
+
+func TestCache_SetMissing(t *testing.T) {
+	ctx := context.Background()
+	backends := map[string]Cache{"lru": NewLRU(10, 0)}
+	if r := New("localhost:6379"); r.client.Ping(ctx).Err() == nil {
+		backends["redis"] = r
+	}
+
+	for name, c := range backends {
+		t.Run(name, func(t *testing.T) {
+			key := "negative_test_key"
+			c.Delete(ctx, key)
+
+			if err := c.SetMissing(ctx, key, 50*time.Millisecond); err != nil {
+				t.Fatalf("SetMissing() error = %v", err)
+			}
+			if e, err := c.GetEntry(ctx, key); err != nil || !e.Missing {
+				t.Errorf("GetEntry() = %+v, %v, want a negative entry", e, err)
+			}
+			if _, err := c.Get(ctx, key); err != ErrMiss {
+				t.Errorf("Get() on negative entry error = %v, want ErrMiss", err)
+			}
+
+			// a write replaces the marker immediately
+			res, err := c.SetIfNewer(ctx, key, Entry{Value: "v", Ts: 1})
+			if err != nil || res != Created {
+				t.Errorf("SetIfNewer() over negative entry = %v, %v, want Created", res, err)
+			}
+			if e, _ := c.GetEntry(ctx, key); e.Missing || e.Value != "v" {
+				t.Errorf("GetEntry() after write = %+v", e)
+			}
+
+			// and a marker never replaces a value
+			c.SetMissing(ctx, key, time.Minute)
+			if e, _ := c.GetEntry(ctx, key); e.Missing {
+				t.Error("SetMissing() overwrote a cached value")
+			}
+
+			other := "negative_test_key2"
+			c.Delete(ctx, other)
+			if err := c.SetManyMissing(ctx, []string{key, other}, time.Minute); err != nil {
+				t.Fatalf("SetManyMissing() error = %v", err)
+			}
+			if e, _ := c.GetEntry(ctx, key); e.Missing {
+				t.Error("SetManyMissing() overwrote a cached value")
+			}
+			if e, err := c.GetEntry(ctx, other); err != nil || !e.Missing {
+				t.Errorf("GetEntry() after SetManyMissing = %+v, %v, want a negative entry", e, err)
+			}
+		})
+	}
+}
+
+func TestCache_SetDeleted(t *testing.T) {
+	ctx := context.Background()
+	backends := map[string]Cache{"lru": NewLRU(10, 0)}
+	if r := New("localhost:6379"); r.client.Ping(ctx).Err() == nil {
+		backends["redis"] = r
+	}
+
+	for name, c := range backends {
+		t.Run(name, func(t *testing.T) {
+			key := "deleted_test_key"
+			c.Delete(ctx, key)
+			c.SetIfNewer(ctx, key, Entry{Value: "old", Ts: 100})
+
+			if err := c.SetDeleted(ctx, key, 200); err != nil {
+				t.Fatalf("SetDeleted() error = %v", err)
+			}
+			if e, err := c.GetEntry(ctx, key); err != nil || !e.Missing || e.Ts != 200 {
+				t.Errorf("GetEntry() = %+v, %v, want a negative entry at 200", e, err)
+			}
+
+			// a refill of the value read before the delete is refused
+			if res, _ := c.SetIfNewer(ctx, key, Entry{Value: "old", Ts: 100}); res != Stale {
+				t.Errorf("SetIfNewer() older than the delete = %v, want Stale", res)
+			}
+			if res, _ := c.SetIfNewer(ctx, key, Entry{Value: "new", Ts: 200}); res != Updated {
+				t.Errorf("SetIfNewer() as new as the delete = %v, want Updated", res)
+			}
+			if e, _ := c.GetEntry(ctx, key); e.Missing || e.Value != "new" {
+				t.Errorf("GetEntry() after write = %+v, want new", e)
+			}
+		})
+	}
+}
+
+func TestLRU_NegativeEntryExpires(t *testing.T) {
+	ctx := context.Background()
+	c := NewLRU(10, time.Minute)
+	c.SetMissing(ctx, "k", 20*time.Millisecond)
+	time.Sleep(40 * time.Millisecond)
+	if _, err := c.GetEntry(ctx, "k"); err != ErrMiss {
+		t.Errorf("GetEntry() after negative ttl error = %v, want ErrMiss", err)
+	}
+}
+
+func TestParsePolicies(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    []Policy
+		wantErr bool
+	}{
+		{"empty", "", nil, false},
+		{
+			name: "mixed",
+			in:   "*=10m, tenantA:=1h:sliding,audit:=none",
+			want: []Policy{
+				{Prefix: "", TTL: 10 * time.Minute},
+				{Prefix: "tenantA:", TTL: time.Hour, Sliding: true},
+				{Prefix: "audit:", NoExpiry: true},
+			},
+		},
+		{"missing ttl", "tenantA:", nil, true},
+		{"bad duration", "a=soon", nil, true},
+		{"sliding without ttl", "a=none:sliding", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParsePolicies(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParsePolicies() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("ParsePolicies() = %+v, want %+v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("ParsePolicies()[%d] = %+v, want %+v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestPolicies_For(t *testing.T) {
+	p := NewPolicies(Policy{TTL: time.Minute},
+		Policy{Prefix: "t:", TTL: time.Hour},
+		Policy{Prefix: "t:hot:", NoExpiry: true},
+	)
+
+	tests := []struct {
+		key  string
+		want Policy
+	}{
+		{"other", Policy{TTL: time.Minute}},
+		{"t:user", Policy{Prefix: "t:", TTL: time.Hour}},
+		{"t:hot:user", Policy{Prefix: "t:hot:", NoExpiry: true}},
+	}
+	for _, tt := range tests {
+		if got := p.For(tt.key); got != tt.want {
+			t.Errorf("For(%q) = %+v, want %+v", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestPolicies_Capped(t *testing.T) {
+	p := NewPolicies(Policy{TTL: time.Minute},
+		Policy{Prefix: "short:", TTL: time.Second},
+		Policy{Prefix: "hot:", TTL: time.Hour, Sliding: true},
+		Policy{Prefix: "pinned:", NoExpiry: true},
+	).Capped(10 * time.Second)
+
+	tests := []struct {
+		key  string
+		want Policy
+	}{
+		{"other", Policy{TTL: 10 * time.Second}},
+		{"short:a", Policy{Prefix: "short:", TTL: time.Second}},
+		{"hot:a", Policy{Prefix: "hot:", TTL: 10 * time.Second}},
+		{"pinned:a", Policy{Prefix: "pinned:", TTL: 10 * time.Second}},
+	}
+	for _, tt := range tests {
+		if got := p.For(tt.key); got != tt.want {
+			t.Errorf("For(%q) = %+v, want %+v", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestLRU_Policies(t *testing.T) {
+	ctx := context.Background()
+	c := NewLRU(10, 0, WithPolicies(NewPolicies(Policy{TTL: 30 * time.Millisecond},
+		Policy{Prefix: "hot:", TTL: 30 * time.Millisecond, Sliding: true},
+		Policy{Prefix: "pinned:", NoExpiry: true},
+	)))
+
+	for _, key := range []string{"cold:a", "hot:a", "pinned:a"} {
+		c.Set(ctx, key, "v")
+	}
+	// keep reading the sliding key past its original expiry
+	for i := 0; i < 4; i++ {
+		time.Sleep(15 * time.Millisecond)
+		c.Get(ctx, "hot:a")
+	}
+
+	tests := []struct {
+		key     string
+		wantErr error
+	}{
+		{"cold:a", ErrMiss},
+		{"hot:a", nil},
+		{"pinned:a", nil},
+	}
+	for _, tt := range tests {
+		if _, err := c.Get(ctx, tt.key); err != tt.wantErr {
+			t.Errorf("Get(%s) error = %v, want %v", tt.key, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package cache
+
+import (
+    "container/list"
+    "context"
+    "sync"
+    "time"
+)
+
+// LRU is an in-process Cache holding at most capacity entries. Entries also
+// expire according to the TTL policy for their key.
+type LRU struct {
+    capacity int
+    policies *Policies
+
+    mu    sync.Mutex
+    ll    *list.List // front is most recently used
+    items map[string]*list.Element
+}
+
+type lruEntry struct {
+    key     string
+    entry   Entry
+    expires time.Time // zero means never
+}
+
+func (e *lruEntry) live(now time.Time) bool {
+    return e.expires.IsZero() || now.Before(e.expires)
+}
+
+var _ Cache = (*LRU)(nil)
+
+// NewLRU returns an LRU holding up to capacity entries for ttl each, unless
+// WithPolicies is given. A zero ttl uses the same default as the Redis cache.
+func NewLRU(capacity int, ttl time.Duration, opts ...Option) *LRU {
+    if capacity <= 0 {
+        capacity = 1
+    }
+    if ttl <= 0 {
+        ttl = DefaultTTL
+    }
+    cfg := config{policies: NewPolicies(Policy{TTL: ttl})}
+    for _, opt := range opts {
+        opt(&cfg)
+    }
+    return &LRU{
+        capacity: capacity,
+        policies: cfg.policies,
+        ll:       list.New(),
+        items:    make(map[string]*list.Element),
+    }
+}
+
+func (c *LRU) Get(ctx context.Context, key string) (string, error) {
+    e, err := c.GetEntry(ctx, key)
+    if err == nil && e.Missing {
+        return "", ErrMiss
+    }
+    return e.Value, err
+}
+
+func (c *LRU) GetEntry(ctx context.Context, key string) (Entry, error) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    el, ok := c.items[key]
+    if !ok {
+        return Entry{}, ErrMiss
+    }
+    e := el.Value.(*lruEntry)
+    now := time.Now()
+    if !e.live(now) {
+        c.removeElement(el)
+        return Entry{}, ErrMiss
+    }
+    if pol := c.policies.For(key); pol.Sliding && !e.entry.Missing {
+        e.expires = now.Add(pol.TTL)
+    }
+    c.ll.MoveToFront(el)
+    return e.entry, nil
+}
+
+func (c *LRU) GetMany(ctx context.Context, keys []string) (map[string]Entry, error) {
+    out := make(map[string]Entry, len(keys))
+    for _, key := range keys {
+        if e, err := c.GetEntry(ctx, key); err == nil {
+            out[key] = e
+        }
+    }
+    return out, nil
+}
+
+func (c *LRU) Set(ctx context.Context, key, val string) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.store(key, Entry{Value: val}, c.policies.For(key).ttl())
+    return nil
+}
+
+func (c *LRU) SetIfNewer(ctx context.Context, key string, e Entry) (SetResult, error) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    res := Created
+    if el, ok := c.items[key]; ok {
+        cur := el.Value.(*lruEntry)
+        // a plain not-found marker has no ts and is always replaced
+        if cur.live(time.Now()) && (!cur.entry.Missing || cur.entry.Ts > 0) {
+            if cur.entry.Ts > e.Ts {
+                return Stale, nil
+            }
+            res = Updated
+        }
+    }
+    c.store(key, e, c.policies.For(key).ttl())
+    return res, nil
+}
+
+func (c *LRU) SetManyIfNewer(ctx context.Context, items []KeyEntry) ([]SetResult, error) {
+    res := make([]SetResult, len(items))
+    for i, it := range items {
+        res[i], _ = c.SetIfNewer(ctx, it.Key, it.Entry)
+    }
+    return res, nil
+}
+
+func (c *LRU) SetMissing(ctx context.Context, key string, ttl time.Duration) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if el, ok := c.items[key]; ok && el.Value.(*lruEntry).live(time.Now()) {
+        return nil
+    }
+    c.store(key, Entry{Missing: true}, ttl)
+    return nil
+}
+
+func (c *LRU) SetManyMissing(ctx context.Context, keys []string, ttl time.Duration) error {
+    for _, key := range keys {
+        _ = c.SetMissing(ctx, key, ttl)
+    }
+    return nil
+}
+
+func (c *LRU) SetDeleted(ctx context.Context, key string, ts int64) error {
+    c.put(key, Entry{Missing: true, Ts: ts})
+    return nil
+}
+
+// put stores e unconditionally.
+func (c *LRU) put(key string, e Entry) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.store(key, e, c.policies.For(key).ttl())
+}
+
+// store puts e under key for ttl; a zero ttl never expires.
+func (c *LRU) store(key string, e Entry, ttl time.Duration) {
+    var expires time.Time
+    if ttl > 0 {
+        expires = time.Now().Add(ttl)
+    }
+    if el, ok := c.items[key]; ok {
+        le := el.Value.(*lruEntry)
+        le.entry, le.expires = e, expires
+        c.ll.MoveToFront(el)
+        return
+    }
+    c.items[key] = c.ll.PushFront(&lruEntry{key: key, entry: e, expires: expires})
+    for c.ll.Len() > c.capacity {
+        c.removeElement(c.ll.Back())
+    }
+}
+
+func (c *LRU) Delete(ctx context.Context, keys ...string) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    for _, key := range keys {
+        if el, ok := c.items[key]; ok {
+            c.removeElement(el)
+        }
+    }
+    return nil
+}
+
+// Len returns the number of entries, including expired ones not yet evicted.
+func (c *LRU) Len() int {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.ll.Len()
+}
+
+func (c *LRU) Ping(ctx context.Context) error {
+    return nil
+}
+
+func (c *LRU) Close() error {
+    return nil
+}
+
+func (c *LRU) removeElement(el *list.Element) {
+    c.ll.Remove(el)
+    delete(c.items, el.Value.(*lruEntry).key)
+}
@@ -0,0 +1,93 @@
+package cache
+
+import (
+    "errors"
+    "fmt"
+    "strings"
+    "time"
+
+    "github.com/yourname/dsproxy/pkg/prefix"
+)
+
+// Policy sets the lifetime of entries whose key starts with Prefix.
+type Policy struct {
+    Prefix string
+    TTL    time.Duration
+    // NoExpiry keeps entries until they are evicted or deleted.
+    NoExpiry bool
+    // Sliding pushes the expiry out by TTL on every read, so only entries
+    // nobody reads expire.
+    Sliding bool
+}
+
+// Policies resolves the Policy for a key by longest matching prefix.
+type Policies struct {
+    *prefix.Table[Policy]
+}
+
+// NewPolicies returns a resolver that falls back to def when no prefix
+// matches. A policy with an empty prefix replaces def.
+func NewPolicies(def Policy, ps ...Policy) *Policies {
+    return &Policies{prefix.New(def, func(pol Policy) string { return pol.Prefix }, ps...)}
+}
+
+// Capped returns the policies with every lifetime limited to max and
+// without sliding, for a cache whose entries must not outlive max, such as
+// the L1 of a Tiered cache.
+func (p *Policies) Capped(max time.Duration) *Policies {
+    return &Policies{p.Map(func(pol Policy) Policy {
+        if pol.NoExpiry || pol.TTL > max {
+            pol.TTL = max
+        }
+        pol.NoExpiry, pol.Sliding = false, false
+        return pol
+    })}
+}
+
+// ttl returns the expiry to apply for pol; 0 means no expiry.
+func (pol Policy) ttl() time.Duration {
+    if pol.NoExpiry {
+        return 0
+    }
+    return pol.TTL
+}
+
+// ParsePolicies parses a comma-separated list of prefix=ttl entries. ttl is
+// a Go duration or "none", optionally followed by ":sliding". The prefix "*"
+// sets the default, e.g.
+//
+//  *=5m,tenantA:=1h:sliding,audit:=none,scratch:=30s
+func ParsePolicies(s string) ([]Policy, error) {
+    return prefix.ParseList(s, "cache policy", func(p, spec string) (Policy, error) {
+        pol := Policy{Prefix: p}
+        if strings.HasSuffix(spec, ":sliding") {
+            pol.Sliding = true
+            spec = strings.TrimSuffix(spec, ":sliding")
+        }
+        if spec == "none" {
+            if pol.Sliding {
+                return Policy{}, errors.New("sliding needs a ttl")
+            }
+            pol.NoExpiry = true
+            return pol, nil
+        }
+        d, err := time.ParseDuration(spec)
+        if err != nil || d <= 0 {
+            return Policy{}, fmt.Errorf("invalid ttl %q", spec)
+        }
+        pol.TTL = d
+        return pol, nil
+    })
+}
+
+type config struct {
+    policies *Policies
+}
+
+type Option func(*config)
+
+// WithPolicies sets per-prefix TTL policies, replacing the 5 minute
+// default for every key.
+func WithPolicies(p *Policies) Option {
+    return func(c *config) { c.policies = p }
+}
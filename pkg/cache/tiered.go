@@ -0,0 +1,282 @@
+package cache
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "log"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/go-redis/redis/v8"
+)
+
+// InvalidationChannel is the Redis pub/sub channel tiered caches use to
+// tell each other which keys changed.
+const InvalidationChannel = "dsproxy:cache:invalidate"
+
+// Tiered checks an in-process LRU (L1) before Redis (L2). Every Set and
+// Delete is published on InvalidationChannel so other instances drop their
+// L1 copy; the L1 TTL bounds staleness if a message is lost.
+//
+// An L1 hit does not reach Redis, so keys with a sliding policy are
+// collected and their Redis expiry pushed out every SlideInterval.
+type Tiered struct {
+    l1     *LRU
+    l2     *Redis
+    origin string
+    pubsub *redis.PubSub
+    done   chan struct{}
+
+    slideMu sync.Mutex
+    slides  map[string]struct{} // read from L1 since the last slide
+    stop    chan struct{}
+    slid    chan struct{}
+
+    // gen counts invalidations, local deletes included. A Get only fills
+    // L1 if no invalidation happened while it was reading L2.
+    gen atomic.Uint64
+}
+
+type invalidation struct {
+    Origin string   `json:"origin"`
+    Keys   []string `json:"keys"`
+}
+
+// SlideInterval is how often a Tiered cache refreshes the Redis expiry of
+// sliding keys read from L1. It must stay well below the shortest sliding
+// TTL.
+const SlideInterval = time.Second
+
+var _ Cache = (*Tiered)(nil)
+
+func NewTiered(l1 *LRU, l2 *Redis) *Tiered {
+    var id [8]byte
+    _, _ = rand.Read(id[:])
+    t := &Tiered{
+        l1:     l1,
+        l2:     l2,
+        origin: hex.EncodeToString(id[:]),
+        pubsub: l2.client.Subscribe(context.Background(), InvalidationChannel),
+        done:   make(chan struct{}),
+        slides: make(map[string]struct{}),
+        stop:   make(chan struct{}),
+        slid:   make(chan struct{}),
+    }
+    go t.listen()
+    go t.slideLoop()
+    return t
+}
+
+func (t *Tiered) Get(ctx context.Context, key string) (string, error) {
+    e, err := t.GetEntry(ctx, key)
+    if err == nil && e.Missing {
+        return "", ErrMiss
+    }
+    return e.Value, err
+}
+
+func (t *Tiered) GetEntry(ctx context.Context, key string) (Entry, error) {
+    if e, err := t.l1.GetEntry(ctx, key); err == nil {
+        t.touch(key, e)
+        return e, nil
+    }
+    gen := t.gen.Load()
+    e, err := t.l2.GetEntry(ctx, key)
+    if err != nil {
+        return Entry{}, err
+    }
+    // negative entries stay in Redis only; their TTL is not known here
+    if !e.Missing && t.gen.Load() == gen {
+        _, _ = t.l1.SetIfNewer(ctx, key, e)
+    }
+    return e, nil
+}
+
+func (t *Tiered) GetMany(ctx context.Context, keys []string) (map[string]Entry, error) {
+    out, _ := t.l1.GetMany(ctx, keys)
+    var rest []string
+    for _, key := range keys {
+        if e, ok := out[key]; ok {
+            t.touch(key, e)
+        } else {
+            rest = append(rest, key)
+        }
+    }
+    if len(rest) == 0 {
+        return out, nil
+    }
+    gen := t.gen.Load()
+    l2, err := t.l2.GetMany(ctx, rest)
+    if err != nil {
+        return nil, err
+    }
+    fill := t.gen.Load() == gen
+    for key, e := range l2 {
+        out[key] = e
+        if fill && !e.Missing {
+            _, _ = t.l1.SetIfNewer(ctx, key, e)
+        }
+    }
+    return out, nil
+}
+
+func (t *Tiered) SetMissing(ctx context.Context, key string, ttl time.Duration) error {
+    return t.l2.SetMissing(ctx, key, ttl)
+}
+
+func (t *Tiered) SetManyMissing(ctx context.Context, keys []string, ttl time.Duration) error {
+    return t.l2.SetManyMissing(ctx, keys, ttl)
+}
+
+func (t *Tiered) Set(ctx context.Context, key, val string) error {
+    if err := t.l2.Set(ctx, key, val); err != nil {
+        // do not leave a value in L1 that other instances cannot see
+        _ = t.l1.Delete(ctx, key)
+        return err
+    }
+    _ = t.l1.Set(ctx, key, val)
+    t.publish(ctx, key)
+    return nil
+}
+
+// SetIfNewer decides against Redis, which is shared by all instances; L1
+// only mirrors the outcome.
+func (t *Tiered) SetIfNewer(ctx context.Context, key string, e Entry) (SetResult, error) {
+    res, err := t.l2.SetIfNewer(ctx, key, e)
+    if err != nil || !res.Applied() {
+        // L1 may hold something other than what Redis has; refetch lazily
+        _ = t.l1.Delete(ctx, key)
+        return res, err
+    }
+    t.l1.put(key, e)
+    t.publish(ctx, key)
+    return res, nil
+}
+
+func (t *Tiered) SetManyIfNewer(ctx context.Context, items []KeyEntry) ([]SetResult, error) {
+    res, err := t.l2.SetManyIfNewer(ctx, items)
+    keys := make([]string, 0, len(items))
+    for i, it := range items {
+        if err != nil || !res[i].Applied() {
+            _ = t.l1.Delete(ctx, it.Key)
+            continue
+        }
+        t.l1.put(it.Key, it.Entry)
+        keys = append(keys, it.Key)
+    }
+    t.publish(ctx, keys...)
+    return res, err
+}
+
+// SetDeleted writes the tombstone to Redis first and keeps a copy in L1, so
+// neither tier can be refilled with an older value afterwards.
+func (t *Tiered) SetDeleted(ctx context.Context, key string, ts int64) error {
+    t.gen.Add(1)
+    if err := t.l2.SetDeleted(ctx, key, ts); err != nil {
+        _ = t.l1.Delete(ctx, key)
+        return err
+    }
+    _ = t.l1.SetDeleted(ctx, key, ts)
+    t.publish(ctx, key)
+    return nil
+}
+
+func (t *Tiered) Delete(ctx context.Context, keys ...string) error {
+    t.gen.Add(1)
+    _ = t.l1.Delete(ctx, keys...)
+    err := t.l2.Delete(ctx, keys...)
+    t.publish(ctx, keys...)
+    return err
+}
+
+// Ping checks Redis; L1 is always reachable.
+func (t *Tiered) Ping(ctx context.Context) error {
+    return t.l2.Ping(ctx)
+}
+
+// Close stops listening for invalidations, slides what is still pending
+// and closes the Redis client.
+func (t *Tiered) Close() error {
+    close(t.stop)
+    <-t.slid
+    err := t.pubsub.Close()
+    <-t.done
+    if cerr := t.l2.Close(); err == nil {
+        err = cerr
+    }
+    return err
+}
+
+func (t *Tiered) publish(ctx context.Context, keys ...string) {
+    if len(keys) == 0 {
+        return
+    }
+    msg, err := json.Marshal(invalidation{Origin: t.origin, Keys: keys})
+    if err != nil {
+        return
+    }
+    if err := t.l2.client.Publish(ctx, InvalidationChannel, msg).Err(); err != nil {
+        log.Printf("cache invalidation publish error: %v", err)
+    }
+}
+
+func (t *Tiered) listen() {
+    defer close(t.done)
+    for msg := range t.pubsub.Channel() {
+        var inv invalidation
+        if err := json.Unmarshal([]byte(msg.Payload), &inv); err != nil {
+            continue
+        }
+        if inv.Origin == t.origin {
+            continue
+        }
+        t.gen.Add(1)
+        _ = t.l1.Delete(context.Background(), inv.Keys...)
+    }
+}
+
+// touch notes an L1 hit on key for the next slide.
+func (t *Tiered) touch(key string, e Entry) {
+    if e.Missing || !t.l2.policies.For(key).Sliding {
+        return
+    }
+    t.slideMu.Lock()
+    t.slides[key] = struct{}{}
+    t.slideMu.Unlock()
+}
+
+func (t *Tiered) slideLoop() {
+    defer close(t.slid)
+    ticker := time.NewTicker(SlideInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-t.stop:
+            t.slide()
+            return
+        case <-ticker.C:
+            t.slide()
+        }
+    }
+}
+
+func (t *Tiered) slide() {
+    t.slideMu.Lock()
+    keys := make([]string, 0, len(t.slides))
+    for key := range t.slides {
+        keys = append(keys, key)
+    }
+    clear(t.slides)
+    t.slideMu.Unlock()
+    if len(keys) == 0 {
+        return
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), SlideInterval)
+    defer cancel()
+    if err := t.l2.slide(ctx, keys); err != nil {
+        log.Printf("cache slide error: %v", err)
+    }
+}
@@ -0,0 +1,55 @@
+package db
+
+import (
+    "context"
+    "errors"
+
+    "github.com/jackc/pgx/v5"
+)
+
+// APIKey describes a client key without the key itself. Only the hex
+// SHA-256 of a key is ever stored.
+type APIKey struct {
+    ID     int64    `json:"id"`
+    Name   string   `json:"name"`
+    Scopes []string `json:"scopes"`
+    // UserPrefix restricts the key to user_ids starting with it; empty
+    // allows every user.
+    UserPrefix string `json:"user_prefix"`
+}
+
+// CreateAPIKey stores k under hash and returns its id.
+func (d *DB) CreateAPIKey(ctx context.Context, hash string, k APIKey) (int64, error) {
+    var id int64
+    err := d.pool.QueryRow(ctx, `INSERT INTO api_keys (name, key_hash, scopes, user_prefix)
+        VALUES ($1, $2, $3, $4) RETURNING id`, k.Name, hash, k.Scopes, k.UserPrefix).Scan(&id)
+    return id, err
+}
+
+// LookupAPIKey returns the unrevoked key with the given hash, or
+// ErrNotFound.
+func (d *DB) LookupAPIKey(ctx context.Context, hash string) (*APIKey, error) {
+    var k APIKey
+    err := d.pool.QueryRow(ctx, `SELECT id, name, scopes, user_prefix FROM api_keys
+        WHERE key_hash=$1 AND revoked_at IS NULL`, hash).Scan(&k.ID, &k.Name, &k.Scopes, &k.UserPrefix)
+    if errors.Is(err, pgx.ErrNoRows) {
+        return nil, ErrNotFound
+    }
+    if err != nil {
+        return nil, err
+    }
+    return &k, nil
+}
+
+// RevokeAPIKey disables key id. Revoking an unknown or revoked key returns
+// ErrNotFound.
+func (d *DB) RevokeAPIKey(ctx context.Context, id int64) error {
+    tag, err := d.pool.Exec(ctx, `UPDATE api_keys SET revoked_at = now() WHERE id=$1 AND revoked_at IS NULL`, id)
+    if err != nil {
+        return err
+    }
+    if tag.RowsAffected() == 0 {
+        return ErrNotFound
+    }
+    return nil
+}
@@ -2,22 +2,77 @@ package db
 
 import (
     "context"
+    "errors"
+    "fmt"
     "log"
+    "strings"
+    "sync/atomic"
 
+    "github.com/jackc/pgx/v5"
+    "github.com/jackc/pgx/v5/pgconn"
     "github.com/jackc/pgx/v5/pgxpool"
 )
 
+// Store is the persistence layer behind the batcher and the handler.
+// *DB is the Postgres implementation; Memory keeps everything in process.
+type Store interface {
+    // InsertBatch appends rows to the history atomically. Rows older than
+    // their user's tombstone are skipped; dropped holds their indexes.
+    InsertBatch(ctx context.Context, rows []Record) (dropped []int, err error)
+    // GetLatest returns the record with the highest ts for user, or
+    // ErrNotFound. Among equal timestamps the last inserted record wins.
+    GetLatest(ctx context.Context, user string) (*Record, error)
+    // GetLatestMany is GetLatest for several users at once. Users without
+    // records are absent from the result.
+    GetLatestMany(ctx context.Context, users []string) (map[string]Record, error)
+    // GetAsOf returns the latest record for user with ts <= asOf, or
+    // ErrNotFound.
+    GetAsOf(ctx context.Context, user string, asOf int64) (*Record, error)
+    // History returns one page of a user's records in (ts, insertion)
+    // order.
+    History(ctx context.Context, q HistoryQuery) (*HistoryPage, error)
+    // DeleteUser removes user's latest value (and, with erase, all of its
+    // history) and records a tombstone: records with ts older than the
+    // tombstone are dropped by later InsertBatch calls.
+    DeleteUser(ctx context.Context, user string, ts int64, erase bool) error
+    // Tombstone returns the ts of user's tombstone, or ErrNotFound.
+    Tombstone(ctx context.Context, user string) (int64, error)
+    // Tombstones is Tombstone for several users at once. Users without a
+    // tombstone are absent from the result.
+    Tombstones(ctx context.Context, users []string) (map[string]int64, error)
+    // Ping checks that the store is reachable.
+    Ping(ctx context.Context) error
+    Close(ctx context.Context)
+}
+
+var ErrNotFound = errors.New("db: record not found")
+
 type DB struct {
-    pool *pgxpool.Pool
+    pool     *pgxpool.Pool
+    strategy atomic.Int32
 }
 
 type Record struct {
-    UserID string
-    Value  string
-    Ts     int64
+    UserID string `json:"user_id"`
+    Value  string `json:"value"`
+    Ts     int64  `json:"ts"`
 }
 
+// New connects to Postgres and applies any pending schema migrations.
 func New(ctx context.Context, url string) (*DB, error) {
+    d, err := Connect(ctx, url)
+    if err != nil {
+        return nil, err
+    }
+    if _, err := d.Migrate(ctx); err != nil {
+        d.pool.Close()
+        return nil, fmt.Errorf("migrate: %w", err)
+    }
+    return d, nil
+}
+
+// Connect connects to Postgres without touching the schema.
+func Connect(ctx context.Context, url string) (*DB, error) {
     cfg, err := pgxpool.ParseConfig(url)
     if err != nil {
         return nil, err
@@ -26,15 +81,6 @@ func New(ctx context.Context, url string) (*DB, error) {
     if err != nil {
         return nil, err
     }
-    // init table
-    if _, err := pool.Exec(ctx, `CREATE TABLE IF NOT EXISTS user_data (
-        user_id TEXT,
-        value TEXT,
-        ts BIGINT
-    );`); err != nil {
-        log.Printf("failed create table: %v", err)
-    }
-
     return &DB{pool: pool}, nil
 }
 
@@ -42,33 +88,189 @@ func (d *DB) Close(ctx context.Context) {
     d.pool.Close()
 }
 
-func (d *DB) InsertBatch(ctx context.Context, rows []Record) error {
+// Ping acquires a pooled connection and round-trips to Postgres.
+func (d *DB) Ping(ctx context.Context) error {
+    return d.pool.Ping(ctx)
+}
+
+// PoolStats is a snapshot of the connection pool.
+type PoolStats struct {
+    Total    int32 `json:"total"`
+    Idle     int32 `json:"idle"`
+    Acquired int32 `json:"acquired"`
+    Max      int32 `json:"max"`
+}
+
+func (d *DB) PoolStats() PoolStats {
+    s := d.pool.Stat()
+    return PoolStats{Total: s.TotalConns(), Idle: s.IdleConns(), Acquired: s.AcquiredConns(), Max: s.MaxConns()}
+}
+
+// InsertStrategy selects how InsertBatch sends rows to Postgres.
+type InsertStrategy int32
+
+const (
+    // StrategyCopy streams rows with the COPY protocol. If the server or a
+    // pooler in between rejects COPY, the DB switches to StrategyValues.
+    StrategyCopy InsertStrategy = iota
+    // StrategyValues sends multi-row INSERT ... VALUES statements.
+    StrategyValues
+    // StrategyPgxBatch pipelines one INSERT per row in a single pgx.Batch.
+    StrategyPgxBatch
+)
+
+// maxValuesRows keeps multi-row INSERTs well under Postgres' limit of 65535
+// bind parameters.
+const maxValuesRows = 1000
+
+func (s InsertStrategy) String() string {
+    switch s {
+    case StrategyCopy:
+        return "copy"
+    case StrategyValues:
+        return "values"
+    case StrategyPgxBatch:
+        return "batch"
+    }
+    return "unknown"
+}
+
+// ParseInsertStrategy maps "copy", "values" and "batch" to an InsertStrategy.
+func ParseInsertStrategy(s string) (InsertStrategy, error) {
+    switch strings.ToLower(s) {
+    case "", "copy":
+        return StrategyCopy, nil
+    case "values":
+        return StrategyValues, nil
+    case "batch":
+        return StrategyPgxBatch, nil
+    }
+    return 0, fmt.Errorf("unknown insert strategy %q", s)
+}
+
+// SetInsertStrategy changes the strategy used by InsertBatch.
+func (d *DB) SetInsertStrategy(s InsertStrategy) {
+    d.strategy.Store(int32(s))
+}
+
+func (d *DB) InsertStrategy() InsertStrategy {
+    return InsertStrategy(d.strategy.Load())
+}
+
+func (d *DB) InsertBatch(ctx context.Context, rows []Record) ([]int, error) {
     if len(rows) == 0 {
-        return nil
+        return nil, nil
     }
-    // simple batch insert using COPY or tx
+    s := d.InsertStrategy()
+    dropped, err := d.insertBatch(ctx, s, rows)
+    if s == StrategyCopy && copyUnsupported(err) {
+        log.Printf("COPY unavailable, falling back to multi-row INSERT: %v", err)
+        d.SetInsertStrategy(StrategyValues)
+        dropped, err = d.insertBatch(ctx, StrategyValues, rows)
+    }
+    return dropped, err
+}
+
+func (d *DB) insertBatch(ctx context.Context, s InsertStrategy, rows []Record) ([]int, error) {
     tx, err := d.pool.Begin(ctx)
     if err != nil {
-        return err
+        return nil, err
     }
     defer tx.Rollback(ctx)
 
-    for _, r := range rows {
-        if _, err := tx.Exec(ctx, `INSERT INTO user_data (user_id,value,ts) VALUES ($1,$2,$3)`, r.UserID, r.Value, r.Ts); err != nil {
+    rows, dropped, err := dropTombstoned(ctx, tx, rows)
+    if err != nil {
+        return nil, err
+    }
+    if len(rows) == 0 {
+        return dropped, tx.Commit(ctx)
+    }
+    switch s {
+    case StrategyCopy:
+        err = insertCopy(ctx, tx, rows)
+    case StrategyValues:
+        err = insertValues(ctx, tx, rows)
+    default:
+        err = insertPgxBatch(ctx, tx, rows)
+    }
+    if err != nil {
+        return nil, err
+    }
+    if err := upsertLatest(ctx, tx, rows); err != nil {
+        return nil, err
+    }
+    return dropped, tx.Commit(ctx)
+}
+
+func insertCopy(ctx context.Context, tx pgx.Tx, rows []Record) error {
+    _, err := tx.CopyFrom(ctx, pgx.Identifier{"user_data"}, []string{"user_id", "value", "ts"},
+        pgx.CopyFromSlice(len(rows), func(i int) ([]any, error) {
+            return []any{rows[i].UserID, rows[i].Value, rows[i].Ts}, nil
+        }))
+    return err
+}
+
+func insertValues(ctx context.Context, tx pgx.Tx, rows []Record) error {
+    for len(rows) > 0 {
+        n := len(rows)
+        if n > maxValuesRows {
+            n = maxValuesRows
+        }
+        sql, args := valuesQuery(rows[:n])
+        if _, err := tx.Exec(ctx, sql, args...); err != nil {
             return err
         }
-    }
-    if err := tx.Commit(ctx); err != nil {
-        return err
+        rows = rows[n:]
     }
     return nil
 }
 
-func (d *DB) GetLatest(ctx context.Context, user string) (*Record, error) {
-    row := d.pool.QueryRow(ctx, `SELECT user_id, value, ts FROM user_data WHERE user_id=$1 ORDER BY ts DESC LIMIT 1`, user)
-    var r Record
-    if err := row.Scan(&r.UserID, &r.Value, &r.Ts); err != nil {
-        return nil, err
+func valuesQuery(rows []Record) (string, []any) {
+    var sb strings.Builder
+    sb.WriteString(`INSERT INTO user_data (user_id,value,ts) VALUES `)
+    args := make([]any, 0, len(rows)*3)
+    for i, r := range rows {
+        if i > 0 {
+            sb.WriteByte(',')
+        }
+        fmt.Fprintf(&sb, "($%d,$%d,$%d)", i*3+1, i*3+2, i*3+3)
+        args = append(args, r.UserID, r.Value, r.Ts)
+    }
+    return sb.String(), args
+}
+
+func insertPgxBatch(ctx context.Context, tx pgx.Tx, rows []Record) error {
+    batch := &pgx.Batch{}
+    for _, r := range rows {
+        batch.Queue(`INSERT INTO user_data (user_id,value,ts) VALUES ($1,$2,$3)`, r.UserID, r.Value, r.Ts)
+    }
+    return tx.SendBatch(ctx, batch).Close()
+}
+
+// copyUnsupported reports whether err means the server (or a proxy in front
+// of it) does not accept COPY FROM STDIN.
+func copyUnsupported(err error) bool {
+    var pgErr *pgconn.PgError
+    if !errors.As(err, &pgErr) {
+        return false
+    }
+    return pgErr.Code == "0A000" || // feature_not_supported
+        pgErr.Code == "42601" // syntax_error
+}
+
+// IsPermanent reports whether err was caused by the data itself (a constraint
+// violation, bad encoding, ...), i.e. whether retrying the same rows can
+// never succeed. Anything else, including auth, schema and read-only
+// errors, is an outage that retrying may outlast.
+func IsPermanent(err error) bool {
+    var pgErr *pgconn.PgError
+    if !errors.As(err, &pgErr) || len(pgErr.Code) < 2 {
+        return false
+    }
+    switch pgErr.Code[:2] {
+    case "22", // data exception
+        "23": // integrity constraint violation
+        return true
     }
-    return &r, nil
+    return false
 }
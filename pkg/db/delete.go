@@ -0,0 +1,116 @@
+package db
+
+import (
+    "context"
+    "errors"
+
+    "github.com/jackc/pgx/v5"
+)
+
+// DeleteUser removes user's current value and records a tombstone at ts:
+// from then on InsertBatch drops the user's records with an older ts. The
+// history stays available for auditing unless erase is set, in which case
+// every row of the user is deleted as well.
+func (d *DB) DeleteUser(ctx context.Context, user string, ts int64, erase bool) error {
+    tx, err := d.pool.Begin(ctx)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback(ctx)
+
+    // waits for flushes holding the tombstone lock, see dropTombstoned
+    if _, err := tx.Exec(ctx, `INSERT INTO user_tombstones (user_id, ts) VALUES ($1, $2)
+        ON CONFLICT (user_id) DO UPDATE SET ts = GREATEST(user_tombstones.ts, excluded.ts), deleted_at = now()`,
+        user, ts); err != nil {
+        return err
+    }
+    if _, err := tx.Exec(ctx, `DELETE FROM user_latest WHERE user_id=$1`, user); err != nil {
+        return err
+    }
+    if erase {
+        if _, err := tx.Exec(ctx, `DELETE FROM user_data WHERE user_id=$1`, user); err != nil {
+            return err
+        }
+    }
+    return tx.Commit(ctx)
+}
+
+func (d *DB) Tombstone(ctx context.Context, user string) (int64, error) {
+    var ts int64
+    err := d.pool.QueryRow(ctx, `SELECT ts FROM user_tombstones WHERE user_id=$1`, user).Scan(&ts)
+    if errors.Is(err, pgx.ErrNoRows) {
+        return 0, ErrNotFound
+    }
+    return ts, err
+}
+
+func (d *DB) Tombstones(ctx context.Context, users []string) (map[string]int64, error) {
+    if len(users) == 0 {
+        return map[string]int64{}, nil
+    }
+    return queryTombstones(ctx, d.pool, users)
+}
+
+// querier is what pgxpool.Pool and pgx.Tx have in common for reads.
+type querier interface {
+    Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+func queryTombstones(ctx context.Context, q querier, users []string) (map[string]int64, error) {
+    res, err := q.Query(ctx, `SELECT user_id, ts FROM user_tombstones WHERE user_id = ANY($1)`, users)
+    if err != nil {
+        return nil, err
+    }
+    defer res.Close()
+    tombstones := make(map[string]int64)
+    for res.Next() {
+        var user string
+        var ts int64
+        if err := res.Scan(&user, &ts); err != nil {
+            return nil, err
+        }
+        tombstones[user] = ts
+    }
+    return tombstones, res.Err()
+}
+
+// dropTombstoned removes rows older than their user's tombstone. The SHARE
+// lock lets flushes run concurrently but makes DeleteUser wait for them, so
+// a delete either sees a flush's rows or the flush sees its tombstone.
+func dropTombstoned(ctx context.Context, tx pgx.Tx, rows []Record) ([]Record, []int, error) {
+    if _, err := tx.Exec(ctx, `LOCK TABLE user_tombstones IN SHARE MODE`); err != nil {
+        return nil, nil, err
+    }
+    seen := make(map[string]bool, len(rows))
+    var users []string
+    for _, r := range rows {
+        if !seen[r.UserID] {
+            seen[r.UserID] = true
+            users = append(users, r.UserID)
+        }
+    }
+    tombstones, err := queryTombstones(ctx, tx, users)
+    if err != nil {
+        return nil, nil, err
+    }
+    kept, dropped := filterTombstoned(rows, tombstones)
+    return kept, dropped, nil
+}
+
+// filterTombstoned returns the rows not older than their user's tombstone,
+// and the indexes of the others.
+func filterTombstoned(rows []Record, tombstones map[string]int64) ([]Record, []int) {
+    if len(tombstones) == 0 {
+        return rows, nil
+    }
+    out := make([]Record, 0, len(rows))
+    var dropped []int
+    for i, r := range rows {
+        if ts, ok := tombstones[r.UserID]; ok && r.Ts < ts {
+            dropped = append(dropped, i)
+            continue
+        }
+        out = append(out, r)
+    }
+    return out, dropped
+}
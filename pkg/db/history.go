@@ -0,0 +1,133 @@
+package db
+
+import (
+    "context"
+    "encoding/base64"
+    "errors"
+    "fmt"
+    "math"
+    "strconv"
+    "strings"
+
+    "github.com/jackc/pgx/v5"
+)
+
+const (
+    DefaultHistoryLimit = 100
+    MaxHistoryLimit     = 1000
+)
+
+var ErrInvalidCursor = errors.New("db: invalid cursor")
+
+// HistoryQuery selects records of one user with From <= ts <= To. Cursor
+// continues from the NextCursor of a previous page.
+type HistoryQuery struct {
+    UserID string
+    From   int64
+    To     int64
+    Limit  int
+    Cursor string
+}
+
+// NewHistoryQuery returns a query over the user's whole history.
+func NewHistoryQuery(user string) HistoryQuery {
+    return HistoryQuery{UserID: user, From: math.MinInt64, To: math.MaxInt64, Limit: DefaultHistoryLimit}
+}
+
+type HistoryPage struct {
+    Records []Record `json:"records"`
+    // NextCursor is empty on the last page.
+    NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// position is a keyset pagination key: records are ordered by (ts, id).
+type position struct {
+    ts int64
+    id int64
+}
+
+var start = position{ts: math.MinInt64, id: math.MinInt64}
+
+func (p position) cursor() string {
+    return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d", p.ts, p.id)))
+}
+
+func (p position) after(o position) bool {
+    return p.ts > o.ts || (p.ts == o.ts && p.id > o.id)
+}
+
+func parseCursor(c string) (position, error) {
+    if c == "" {
+        return start, nil
+    }
+    raw, err := base64.RawURLEncoding.DecodeString(c)
+    if err != nil {
+        return position{}, ErrInvalidCursor
+    }
+    tsStr, idStr, ok := strings.Cut(string(raw), ":")
+    if !ok {
+        return position{}, ErrInvalidCursor
+    }
+    ts, err1 := strconv.ParseInt(tsStr, 10, 64)
+    id, err2 := strconv.ParseInt(idStr, 10, 64)
+    if err1 != nil || err2 != nil {
+        return position{}, ErrInvalidCursor
+    }
+    return position{ts: ts, id: id}, nil
+}
+
+func clampLimit(n int) int {
+    if n <= 0 {
+        return DefaultHistoryLimit
+    }
+    if n > MaxHistoryLimit {
+        return MaxHistoryLimit
+    }
+    return n
+}
+
+func (d *DB) GetAsOf(ctx context.Context, user string, asOf int64) (*Record, error) {
+    row := d.pool.QueryRow(ctx, `SELECT user_id, value, ts FROM user_data
+        WHERE user_id=$1 AND ts <= $2 ORDER BY ts DESC, id DESC LIMIT 1`, user, asOf)
+    var r Record
+    if err := row.Scan(&r.UserID, &r.Value, &r.Ts); err != nil {
+        if errors.Is(err, pgx.ErrNoRows) {
+            return nil, ErrNotFound
+        }
+        return nil, err
+    }
+    return &r, nil
+}
+
+func (d *DB) History(ctx context.Context, q HistoryQuery) (*HistoryPage, error) {
+    after, err := parseCursor(q.Cursor)
+    if err != nil {
+        return nil, err
+    }
+    limit := clampLimit(q.Limit)
+    // fetch one extra row to learn whether there is another page
+    rows, err := d.pool.Query(ctx, `SELECT id, user_id, value, ts FROM user_data
+        WHERE user_id=$1 AND ts >= $2 AND ts <= $3 AND (ts, id) > ($4, $5)
+        ORDER BY ts, id LIMIT $6`,
+        q.UserID, q.From, q.To, after.ts, after.id, limit+1)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    page := &HistoryPage{Records: make([]Record, 0, limit)}
+    var last position
+    for rows.Next() {
+        if len(page.Records) == limit {
+            page.NextCursor = last.cursor()
+            break
+        }
+        var r Record
+        if err := rows.Scan(&last.id, &r.UserID, &r.Value, &r.Ts); err != nil {
+            return nil, err
+        }
+        last.ts = r.Ts
+        page.Records = append(page.Records, r)
+    }
+    return page, rows.Err()
+}
@@ -0,0 +1,80 @@
+package db
+
+import (
+    "context"
+    "errors"
+    "sort"
+
+    "github.com/jackc/pgx/v5"
+)
+
+// upsertLatest folds rows into user_latest. It runs in the same transaction
+// as the history insert so both tables always agree. A row replaces the
+// stored one when its ts is not older, matching GetLatest's tie rule: the
+// later insert wins.
+func upsertLatest(ctx context.Context, tx pgx.Tx, rows []Record) error {
+    latest := latestPerUser(rows)
+    users := make([]string, len(latest))
+    values := make([]string, len(latest))
+    tss := make([]int64, len(latest))
+    for i, r := range latest {
+        users[i], values[i], tss[i] = r.UserID, r.Value, r.Ts
+    }
+    _, err := tx.Exec(ctx, `INSERT INTO user_latest (user_id, value, ts)
+        SELECT * FROM unnest($1::text[], $2::text[], $3::bigint[])
+        ON CONFLICT (user_id) DO UPDATE SET value = excluded.value, ts = excluded.ts
+        WHERE excluded.ts >= user_latest.ts`, users, values, tss)
+    return err
+}
+
+// latestPerUser returns the record each user would read back after rows
+// are inserted, sorted by user so concurrent flushes lock user_latest rows
+// in the same order. ON CONFLICT cannot touch a row twice in one statement,
+// hence one record per user.
+func latestPerUser(rows []Record) []Record {
+    idx := make(map[string]int, len(rows))
+    var out []Record
+    for _, r := range rows {
+        i, ok := idx[r.UserID]
+        if !ok {
+            idx[r.UserID] = len(out)
+            out = append(out, r)
+        } else if r.Ts >= out[i].Ts {
+            out[i] = r
+        }
+    }
+    sort.Slice(out, func(i, j int) bool { return out[i].UserID < out[j].UserID })
+    return out
+}
+
+func (d *DB) GetLatest(ctx context.Context, user string) (*Record, error) {
+    row := d.pool.QueryRow(ctx, `SELECT user_id, value, ts FROM user_latest WHERE user_id=$1`, user)
+    var r Record
+    if err := row.Scan(&r.UserID, &r.Value, &r.Ts); err != nil {
+        if errors.Is(err, pgx.ErrNoRows) {
+            return nil, ErrNotFound
+        }
+        return nil, err
+    }
+    return &r, nil
+}
+
+func (d *DB) GetLatestMany(ctx context.Context, users []string) (map[string]Record, error) {
+    out := make(map[string]Record, len(users))
+    if len(users) == 0 {
+        return out, nil
+    }
+    rows, err := d.pool.Query(ctx, `SELECT user_id, value, ts FROM user_latest WHERE user_id = ANY($1)`, users)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var r Record
+        if err := rows.Scan(&r.UserID, &r.Value, &r.Ts); err != nil {
+            return nil, err
+        }
+        out[r.UserID] = r
+    }
+    return out, rows.Err()
+}
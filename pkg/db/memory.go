@@ -0,0 +1,156 @@
+package db
+
+import (
+    "context"
+    "sort"
+    "sync"
+)
+
+// Memory is an in-process Store. It keeps the full history like the
+// Postgres backend does and is meant for tests and running the proxy
+// without external services.
+type Memory struct {
+    mu      sync.RWMutex
+    nextID  int64
+    history map[string][]memRecord // per user, in insertion order
+    latest  map[string]Record      // mirrors the user_latest table
+    tombs   map[string]int64
+}
+
+// memRecord carries the insertion id that Postgres keeps in user_data.id.
+type memRecord struct {
+    Record
+    id int64
+}
+
+func (r memRecord) pos() position {
+    return position{ts: r.Ts, id: r.id}
+}
+
+var _ Store = (*Memory)(nil)
+var _ Store = (*DB)(nil)
+
+func NewMemory() *Memory {
+    return &Memory{history: make(map[string][]memRecord), latest: make(map[string]Record), tombs: make(map[string]int64)}
+}
+
+func (m *Memory) InsertBatch(ctx context.Context, rows []Record) ([]int, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    kept, dropped := filterTombstoned(rows, m.tombs)
+    for _, r := range kept {
+        m.nextID++
+        m.history[r.UserID] = append(m.history[r.UserID], memRecord{Record: r, id: m.nextID})
+        if cur, ok := m.latest[r.UserID]; !ok || r.Ts >= cur.Ts {
+            m.latest[r.UserID] = r
+        }
+    }
+    return dropped, nil
+}
+
+func (m *Memory) GetLatest(ctx context.Context, user string) (*Record, error) {
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+    rec, ok := m.latest[user]
+    if !ok {
+        return nil, ErrNotFound
+    }
+    return &rec, nil
+}
+
+func (m *Memory) GetLatestMany(ctx context.Context, users []string) (map[string]Record, error) {
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+    out := make(map[string]Record, len(users))
+    for _, u := range users {
+        if rec, ok := m.latest[u]; ok {
+            out[u] = rec
+        }
+    }
+    return out, nil
+}
+
+func (m *Memory) GetAsOf(ctx context.Context, user string, asOf int64) (*Record, error) {
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+    var best *memRecord
+    for i, r := range m.history[user] {
+        if r.Ts <= asOf && (best == nil || r.pos().after(best.pos())) {
+            best = &m.history[user][i]
+        }
+    }
+    if best == nil {
+        return nil, ErrNotFound
+    }
+    rec := best.Record
+    return &rec, nil
+}
+
+func (m *Memory) History(ctx context.Context, q HistoryQuery) (*HistoryPage, error) {
+    after, err := parseCursor(q.Cursor)
+    if err != nil {
+        return nil, err
+    }
+    limit := clampLimit(q.Limit)
+
+    m.mu.RLock()
+    var matched []memRecord
+    for _, r := range m.history[q.UserID] {
+        if r.Ts >= q.From && r.Ts <= q.To && r.pos().after(after) {
+            matched = append(matched, r)
+        }
+    }
+    m.mu.RUnlock()
+    sort.Slice(matched, func(i, j int) bool { return matched[j].pos().after(matched[i].pos()) })
+
+    page := &HistoryPage{Records: make([]Record, 0, limit)}
+    for i, r := range matched {
+        if i == limit {
+            page.NextCursor = matched[i-1].pos().cursor()
+            break
+        }
+        page.Records = append(page.Records, r.Record)
+    }
+    return page, nil
+}
+
+func (m *Memory) DeleteUser(ctx context.Context, user string, ts int64, erase bool) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if cur, ok := m.tombs[user]; !ok || ts > cur {
+        m.tombs[user] = ts
+    }
+    delete(m.latest, user)
+    if erase {
+        delete(m.history, user)
+    }
+    return nil
+}
+
+func (m *Memory) Tombstone(ctx context.Context, user string) (int64, error) {
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+    ts, ok := m.tombs[user]
+    if !ok {
+        return 0, ErrNotFound
+    }
+    return ts, nil
+}
+
+func (m *Memory) Tombstones(ctx context.Context, users []string) (map[string]int64, error) {
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+    out := make(map[string]int64)
+    for _, u := range users {
+        if ts, ok := m.tombs[u]; ok {
+            out[u] = ts
+        }
+    }
+    return out, nil
+}
+
+func (m *Memory) Ping(ctx context.Context) error {
+    return nil
+}
+
+func (m *Memory) Close(ctx context.Context) {}
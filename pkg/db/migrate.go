@@ -0,0 +1,203 @@
+package db
+
+import (
+    "context"
+    "embed"
+    "fmt"
+    "io/fs"
+    "log"
+    "path"
+    "sort"
+    "strconv"
+    "strings"
+
+    "github.com/jackc/pgx/v5/pgxpool"
+)
+
+//go:embed migrations/*.sql
+var migrationFS embed.FS
+
+// migrationLockID is the pg_advisory_lock key held while migrating, so that
+// instances starting at the same time apply each migration once.
+const migrationLockID int64 = 0x64737072_6f787900 // "dsproxy\x00"
+
+// Migration is one schema change, read from migrations/NNNN_name.up.sql and
+// the matching .down.sql.
+type Migration struct {
+    Version int
+    Name    string
+    Up      string
+    Down    string
+}
+
+// Migrations returns the embedded migrations ordered by version.
+func Migrations() ([]Migration, error) {
+    return loadMigrations(migrationFS, "migrations")
+}
+
+func loadMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+    files, err := fs.ReadDir(fsys, dir)
+    if err != nil {
+        return nil, err
+    }
+    byVersion := make(map[int]*Migration)
+    for _, f := range files {
+        base, dirn := strings.TrimSuffix(f.Name(), ".sql"), ""
+        switch {
+        case strings.HasSuffix(base, ".up"):
+            base, dirn = strings.TrimSuffix(base, ".up"), "up"
+        case strings.HasSuffix(base, ".down"):
+            base, dirn = strings.TrimSuffix(base, ".down"), "down"
+        default:
+            return nil, fmt.Errorf("migration %s: name must end in .up.sql or .down.sql", f.Name())
+        }
+        num, name, _ := strings.Cut(base, "_")
+        v, err := strconv.Atoi(num)
+        if err != nil || v <= 0 {
+            return nil, fmt.Errorf("migration %s: invalid version %q", f.Name(), num)
+        }
+        body, err := fs.ReadFile(fsys, path.Join(dir, f.Name()))
+        if err != nil {
+            return nil, err
+        }
+        m := byVersion[v]
+        if m == nil {
+            m = &Migration{Version: v, Name: name}
+            byVersion[v] = m
+        } else if m.Name != name {
+            return nil, fmt.Errorf("migration %d: conflicting names %q and %q", v, m.Name, name)
+        }
+        if dirn == "up" {
+            m.Up = string(body)
+        } else {
+            m.Down = string(body)
+        }
+    }
+
+    out := make([]Migration, 0, len(byVersion))
+    for _, m := range byVersion {
+        if m.Up == "" {
+            return nil, fmt.Errorf("migration %d_%s: missing .up.sql", m.Version, m.Name)
+        }
+        out = append(out, *m)
+    }
+    sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+    return out, nil
+}
+
+// Migrate applies all pending migrations and returns the ones it applied.
+func (d *DB) Migrate(ctx context.Context) ([]Migration, error) {
+    all, err := Migrations()
+    if err != nil {
+        return nil, err
+    }
+    var applied []Migration
+    err = d.withMigrationLock(ctx, func(conn *pgxpool.Conn, current int) error {
+        for _, m := range all {
+            if m.Version <= current {
+                continue
+            }
+            if err := runMigration(ctx, conn, m, m.Up,
+                `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, m.Version, m.Name); err != nil {
+                return err
+            }
+            log.Printf("applied migration %d_%s", m.Version, m.Name)
+            applied = append(applied, m)
+        }
+        return nil
+    })
+    return applied, err
+}
+
+// Rollback reverts the last steps applied migrations, newest first, and
+// returns the ones it reverted.
+func (d *DB) Rollback(ctx context.Context, steps int) ([]Migration, error) {
+    all, err := Migrations()
+    if err != nil {
+        return nil, err
+    }
+    var reverted []Migration
+    err = d.withMigrationLock(ctx, func(conn *pgxpool.Conn, current int) error {
+        for i := len(all) - 1; i >= 0 && len(reverted) < steps; i-- {
+            m := all[i]
+            if m.Version > current {
+                continue
+            }
+            if m.Down == "" {
+                return fmt.Errorf("migration %d_%s cannot be reverted: no .down.sql", m.Version, m.Name)
+            }
+            if err := runMigration(ctx, conn, m, m.Down,
+                `DELETE FROM schema_migrations WHERE version = $1`, m.Version); err != nil {
+                return err
+            }
+            log.Printf("reverted migration %d_%s", m.Version, m.Name)
+            reverted = append(reverted, m)
+        }
+        return nil
+    })
+    return reverted, err
+}
+
+// SchemaVersion returns the version of the newest applied migration, or 0.
+// It only reads: a database never migrated has no schema_migrations table
+// and is at version 0.
+func (d *DB) SchemaVersion(ctx context.Context) (int, error) {
+    var exists bool
+    if err := d.pool.QueryRow(ctx, `SELECT to_regclass('schema_migrations') IS NOT NULL`).Scan(&exists); err != nil {
+        return 0, err
+    }
+    if !exists {
+        return 0, nil
+    }
+    var v int
+    err := d.pool.QueryRow(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&v)
+    return v, err
+}
+
+// withMigrationLock runs fn on a connection holding the migration lock,
+// passing the current schema version.
+func (d *DB) withMigrationLock(ctx context.Context, fn func(conn *pgxpool.Conn, current int) error) error {
+    conn, err := d.pool.Acquire(ctx)
+    if err != nil {
+        return err
+    }
+    defer conn.Release()
+
+    if _, err := conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, migrationLockID); err != nil {
+        return fmt.Errorf("acquire migration lock: %w", err)
+    }
+    defer func() {
+        // unlock even if ctx is done, or the session keeps the lock
+        _, _ = conn.Exec(context.WithoutCancel(ctx), `SELECT pg_advisory_unlock($1)`, migrationLockID)
+    }()
+
+    if _, err := conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+        version BIGINT PRIMARY KEY,
+        name TEXT NOT NULL,
+        applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+    )`); err != nil {
+        return fmt.Errorf("create schema_migrations: %w", err)
+    }
+    var current int
+    if err := conn.QueryRow(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+        return err
+    }
+    return fn(conn, current)
+}
+
+// runMigration executes body and the bookkeeping statement in one
+// transaction.
+func runMigration(ctx context.Context, conn *pgxpool.Conn, m Migration, body, record string, args ...any) error {
+    tx, err := conn.Begin(ctx)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback(ctx)
+    if _, err := tx.Exec(ctx, body); err != nil {
+        return fmt.Errorf("migration %d_%s: %w", m.Version, m.Name, err)
+    }
+    if _, err := tx.Exec(ctx, record, args...); err != nil {
+        return err
+    }
+    return tx.Commit(ctx)
+}
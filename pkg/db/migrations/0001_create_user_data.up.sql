@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS user_data (
+    user_id TEXT,
+    value TEXT,
+    ts BIGINT
+);
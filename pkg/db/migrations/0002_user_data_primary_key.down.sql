@@ -0,0 +1,2 @@
+ALTER TABLE user_data DROP CONSTRAINT IF EXISTS user_data_pkey;
+ALTER TABLE user_data DROP COLUMN IF EXISTS id;
@@ -0,0 +1,4 @@
+-- id records insertion order; it breaks ts ties and backs history pagination.
+-- Tables created before migrations may already have the column.
+ALTER TABLE user_data ADD COLUMN IF NOT EXISTS id BIGSERIAL;
+ALTER TABLE user_data ADD CONSTRAINT user_data_pkey PRIMARY KEY (id);
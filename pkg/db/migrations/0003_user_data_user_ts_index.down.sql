@@ -0,0 +1 @@
+DROP INDEX IF EXISTS user_data_user_id_ts_idx;
@@ -0,0 +1,2 @@
+-- serves GetLatest, GetAsOf and History, which all seek on (user_id, ts, id)
+CREATE INDEX IF NOT EXISTS user_data_user_id_ts_idx ON user_data (user_id, ts, id);
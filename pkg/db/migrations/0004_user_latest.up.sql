@@ -0,0 +1,14 @@
+-- latest value per user, kept up to date by InsertBatch so that GetLatest
+-- does not scan the history
+CREATE TABLE IF NOT EXISTS user_latest (
+    user_id TEXT PRIMARY KEY,
+    value TEXT,
+    ts BIGINT NOT NULL
+);
+
+INSERT INTO user_latest (user_id, value, ts)
+SELECT DISTINCT ON (user_id) user_id, value, ts
+FROM user_data
+WHERE user_id IS NOT NULL AND ts IS NOT NULL
+ORDER BY user_id, ts DESC, id DESC
+ON CONFLICT (user_id) DO NOTHING;
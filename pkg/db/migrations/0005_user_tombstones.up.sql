@@ -0,0 +1,6 @@
+-- writes older than ts are rejected for a deleted user
+CREATE TABLE IF NOT EXISTS user_tombstones (
+    user_id TEXT PRIMARY KEY,
+    ts BIGINT NOT NULL,
+    deleted_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
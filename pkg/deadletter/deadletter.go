@@ -0,0 +1,233 @@
+package deadletter
+
+import (
+    "bufio"
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "os"
+    "path/filepath"
+    "sync"
+    "time"
+
+    "github.com/yourname/dsproxy/pkg/db"
+)
+
+// Entry is a record the batcher gave up on, with the error that made it
+// give up.
+type Entry struct {
+    ID       string    `json:"id"`
+    Record   db.Record `json:"record"`
+    Error    string    `json:"error"`
+    FailedAt time.Time `json:"failed_at"`
+}
+
+// File is a dead-letter store kept as a JSON-lines file. Adds are appended
+// and fsynced; removals rewrite the file.
+type File struct {
+    path string
+
+    mu      sync.Mutex
+    f       *os.File
+    entries []Entry
+    claimed map[string]bool // ids being redriven
+}
+
+func Open(path string) (*File, error) {
+    if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+        return nil, err
+    }
+    d := &File{path: path, claimed: make(map[string]bool)}
+    if err := d.load(); err != nil {
+        return nil, err
+    }
+    f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+    if err != nil {
+        return nil, err
+    }
+    d.f = f
+    return d, nil
+}
+
+func (d *File) load() error {
+    f, err := os.Open(d.path)
+    if os.IsNotExist(err) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    sc := bufio.NewScanner(f)
+    sc.Buffer(make([]byte, 64*1024), 16<<20)
+    for sc.Scan() {
+        var e Entry
+        if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+            // partial line from a crash mid-append
+            continue
+        }
+        d.entries = append(d.entries, e)
+    }
+    return sc.Err()
+}
+
+// Put dead-letters recs with cause as the recorded error.
+func (d *File) Put(ctx context.Context, recs []db.Record, cause error) error {
+    now := time.Now().UTC()
+    var buf []byte
+    added := make([]Entry, 0, len(recs))
+    for _, r := range recs {
+        e := Entry{ID: newID(), Record: r, FailedAt: now}
+        if cause != nil {
+            e.Error = cause.Error()
+        }
+        line, err := json.Marshal(e)
+        if err != nil {
+            return err
+        }
+        buf = append(append(buf, line...), '\n')
+        added = append(added, e)
+    }
+
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    if _, err := d.f.Write(buf); err != nil {
+        return err
+    }
+    if err := d.f.Sync(); err != nil {
+        return err
+    }
+    d.entries = append(d.entries, added...)
+    return nil
+}
+
+// List returns up to limit entries, oldest first. limit <= 0 returns all.
+func (d *File) List(ctx context.Context, limit int) ([]Entry, error) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    n := len(d.entries)
+    if limit > 0 && limit < n {
+        n = limit
+    }
+    out := make([]Entry, n)
+    copy(out, d.entries[:n])
+    return out, nil
+}
+
+// Remove deletes the entries with the given ids, or every entry when ids is
+// empty, and returns what was removed.
+func (d *File) Remove(ctx context.Context, ids []string) ([]Entry, error) {
+    want := make(map[string]bool, len(ids))
+    for _, id := range ids {
+        want[id] = true
+    }
+    return d.removeFunc(func(e Entry) bool { return len(ids) == 0 || want[e.ID] })
+}
+
+// Claim marks the entries with the given ids, or every entry when ids is
+// empty, as being redriven and returns them. Entries another Claim holds
+// are skipped, so concurrent redrives never enqueue one record twice. Each
+// claimed id must be passed to Remove once its record is enqueued, or to
+// Release.
+func (d *File) Claim(ctx context.Context, ids []string) ([]Entry, error) {
+    want := make(map[string]bool, len(ids))
+    for _, id := range ids {
+        want[id] = true
+    }
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    var out []Entry
+    for _, e := range d.entries {
+        if (len(ids) == 0 || want[e.ID]) && !d.claimed[e.ID] {
+            d.claimed[e.ID] = true
+            out = append(out, e)
+        }
+    }
+    return out, nil
+}
+
+// Release gives up the claim on ids without removing the entries.
+func (d *File) Release(ctx context.Context, ids []string) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    for _, id := range ids {
+        delete(d.claimed, id)
+    }
+}
+
+// RemoveUser deletes every entry holding a record of user and returns what
+// was removed.
+func (d *File) RemoveUser(ctx context.Context, user string) ([]Entry, error) {
+    return d.removeFunc(func(e Entry) bool { return e.Record.UserID == user })
+}
+
+func (d *File) removeFunc(match func(Entry) bool) ([]Entry, error) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    var removed, kept []Entry
+    for _, e := range d.entries {
+        if match(e) {
+            removed = append(removed, e)
+        } else {
+            kept = append(kept, e)
+        }
+    }
+    if len(removed) == 0 {
+        return nil, nil
+    }
+    if err := d.rewrite(kept); err != nil {
+        return nil, err
+    }
+    d.entries = kept
+    for _, e := range removed {
+        delete(d.claimed, e.ID)
+    }
+    return removed, nil
+}
+
+// rewrite atomically replaces the file with entries. The new file's handle
+// becomes the append handle, so on error nothing has changed.
+func (d *File) rewrite(entries []Entry) error {
+    tmp := d.path + ".tmp"
+    f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0o644)
+    if err != nil {
+        return err
+    }
+    fail := func(err error) error {
+        f.Close()
+        os.Remove(tmp)
+        return err
+    }
+    w := bufio.NewWriter(f)
+    enc := json.NewEncoder(w)
+    for _, e := range entries {
+        if err := enc.Encode(e); err != nil {
+            return fail(err)
+        }
+    }
+    if err := w.Flush(); err != nil {
+        return fail(err)
+    }
+    if err := f.Sync(); err != nil {
+        return fail(err)
+    }
+    if err := os.Rename(tmp, d.path); err != nil {
+        return fail(err)
+    }
+    d.f.Close()
+    d.f = f
+    return nil
+}
+
+func (d *File) Close() error {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    return d.f.Close()
+}
+
+func newID() string {
+    var b [8]byte
+    _, _ = rand.Read(b[:])
+    return hex.EncodeToString(b[:])
+}
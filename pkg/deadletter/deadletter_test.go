@@ -0,0 +1,159 @@
+package deadletter
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/yourname/dsproxy/pkg/db"
+)
+
+func TestFile_PutListRemove(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "dlq", "records.jsonl")
+	d, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+
+	recs := []db.Record{
+		{UserID: "u1", Value: "v1", Ts: 1},
+		{UserID: "u2", Value: "v2", Ts: 2},
+		{UserID: "u3", Value: "v3", Ts: 3},
+	}
+	if err := d.Put(ctx, recs, errors.New("bad row")); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	got, _ := d.List(ctx, 2)
+	if len(got) != 2 {
+		t.Fatalf("List(2) returned %d entries", len(got))
+	}
+	if got[0].Record != recs[0] || got[0].Error != "bad row" || got[0].ID == "" {
+		t.Errorf("List()[0] = %+v", got[0])
+	}
+
+	removed, err := d.Remove(ctx, []string{got[1].ID})
+	if err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	if len(removed) != 1 || removed[0].Record != recs[1] {
+		t.Errorf("Remove() = %+v", removed)
+	}
+	d.Close()
+
+	// state survives a reopen
+	d, err = Open(path)
+	if err != nil {
+		t.Fatalf("reopen error = %v", err)
+	}
+	defer d.Close()
+	all, _ := d.List(ctx, 0)
+	if len(all) != 2 || all[0].Record != recs[0] || all[1].Record != recs[2] {
+		t.Errorf("List() after reopen = %+v", all)
+	}
+
+	removed, _ = d.Remove(ctx, nil)
+	if len(removed) != 2 {
+		t.Errorf("Remove(nil) removed %d entries, want 2", len(removed))
+	}
+	if all, _ := d.List(ctx, 0); len(all) != 0 {
+		t.Errorf("List() after removing all = %+v", all)
+	}
+}
+
+func TestFile_RemoveUser(t *testing.T) {
+	ctx := context.Background()
+	d, err := Open(filepath.Join(t.TempDir(), "records.jsonl"))
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer d.Close()
+
+	_ = d.Put(ctx, []db.Record{
+		{UserID: "u1", Value: "a", Ts: 1},
+		{UserID: "u2", Value: "b", Ts: 2},
+		{UserID: "u1", Value: "c", Ts: 3},
+	}, errors.New("bad row"))
+
+	removed, err := d.RemoveUser(ctx, "u1")
+	if err != nil || len(removed) != 2 {
+		t.Fatalf("RemoveUser() = %d entries, %v, want 2", len(removed), err)
+	}
+	if all, _ := d.List(ctx, 0); len(all) != 1 || all[0].Record.UserID != "u2" {
+		t.Errorf("List() after RemoveUser = %+v", all)
+	}
+}
+
+func TestFile_Claim(t *testing.T) {
+	ctx := context.Background()
+	d, err := Open(filepath.Join(t.TempDir(), "records.jsonl"))
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer d.Close()
+
+	_ = d.Put(ctx, []db.Record{{UserID: "u1", Value: "a", Ts: 1}, {UserID: "u2", Value: "b", Ts: 2}}, nil)
+	first, _ := d.Claim(ctx, nil)
+	if len(first) != 2 {
+		t.Fatalf("Claim() = %d entries, want 2", len(first))
+	}
+	// appended after the claim, so not part of it
+	_ = d.Put(ctx, []db.Record{{UserID: "u3", Value: "c", Ts: 3}}, nil)
+	second, _ := d.Claim(ctx, nil)
+	if len(second) != 1 || second[0].Record.UserID != "u3" {
+		t.Fatalf("second Claim() = %+v, want only the new entry", second)
+	}
+
+	d.Release(ctx, []string{first[1].ID})
+	if again, _ := d.Claim(ctx, []string{first[0].ID, first[1].ID}); len(again) != 1 || again[0].ID != first[1].ID {
+		t.Errorf("Claim() after Release = %+v, want the released entry", again)
+	}
+	if _, err := d.Remove(ctx, []string{first[0].ID}); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	if all, _ := d.List(ctx, 0); len(all) != 2 {
+		t.Errorf("List() = %+v, want the two unremoved entries", all)
+	}
+}
+
+func TestFile_RewriteFailure(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "records.jsonl")
+	d, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer d.Close()
+	d.Put(ctx, []db.Record{{UserID: "u1"}, {UserID: "u2"}}, errors.New("bad row"))
+
+	// a directory where the temporary file goes makes the rewrite fail
+	if err := os.Mkdir(path+".tmp", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.RemoveUser(ctx, "u1"); err == nil {
+		t.Fatal("RemoveUser() error = nil, want the rewrite error")
+	}
+	if all, _ := d.List(ctx, 0); len(all) != 2 {
+		t.Errorf("List() after failed removal = %d entries, want 2", len(all))
+	}
+	os.Remove(path + ".tmp")
+
+	if _, err := d.RemoveUser(ctx, "u1"); err != nil {
+		t.Fatalf("RemoveUser() error = %v", err)
+	}
+	// the append handle still points at the live file
+	if err := d.Put(ctx, []db.Record{{UserID: "u3"}}, nil); err != nil {
+		t.Fatalf("Put() after rewrite error = %v", err)
+	}
+	d2, err := Open(path)
+	if err != nil {
+		t.Fatalf("reopen error = %v", err)
+	}
+	defer d2.Close()
+	if all, _ := d2.List(ctx, 0); len(all) != 2 || all[0].Record.UserID != "u2" || all[1].Record.UserID != "u3" {
+		t.Errorf("List() after reopen = %+v", all)
+	}
+}
@@ -0,0 +1,91 @@
+package handler
+
+import (
+    "encoding/json"
+    "net/http"
+    "strconv"
+)
+
+type redriveReq struct {
+    // IDs of the entries to re-drive; empty means all of them
+    IDs []string `json:"ids"`
+}
+
+type redriveResp struct {
+    Redriven int      `json:"redriven"`
+    Failed   []string `json:"failed,omitempty"`
+}
+
+func (h *Handler) deadLetterListHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "method", http.StatusMethodNotAllowed)
+        return
+    }
+    limit := 100
+    if v := r.URL.Query().Get("limit"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil {
+            http.Error(w, "invalid limit", http.StatusBadRequest)
+            return
+        }
+        limit = n
+    }
+    entries, err := h.deadLetter.List(r.Context(), limit)
+    if err != nil {
+        http.Error(w, "dead-letter error", http.StatusInternalServerError)
+        return
+    }
+    writeJSON(w, http.StatusOK, entries)
+}
+
+// deadLetterRedriveHandler moves dead-lettered records back onto the batcher
+// queue. The entries are claimed first, so that concurrent redrives do not
+// enqueue a record twice, and only removed once their record is enqueued:
+// a crash in between redrives them twice rather than losing them. Entries
+// that cannot be enqueued stay in the dead-letter store.
+func (h *Handler) deadLetterRedriveHandler(w http.ResponseWriter, r *http.Request) {
+    ctx := r.Context()
+    if r.Method != http.MethodPost {
+        http.Error(w, "method", http.StatusMethodNotAllowed)
+        return
+    }
+    var req redriveReq
+    if r.ContentLength != 0 {
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+    }
+    entries, err := h.deadLetter.Claim(ctx, req.IDs)
+    if err != nil {
+        http.Error(w, "dead-letter error", http.StatusInternalServerError)
+        return
+    }
+    var resp redriveResp
+    var done []string
+    for _, e := range entries {
+        rec := e.Record
+        if _, err := h.batcher.Enqueue(rec.UserID, rec.Value, rec.Ts); err != nil {
+            resp.Failed = append(resp.Failed, e.ID)
+            continue
+        }
+        done = append(done, e.ID)
+    }
+    h.deadLetter.Release(ctx, resp.Failed)
+    if len(done) > 0 {
+        // an empty id list would remove everything
+        if _, err := h.deadLetter.Remove(ctx, done); err != nil {
+            h.deadLetter.Release(ctx, done)
+            http.Error(w, "dead-letter error", http.StatusInternalServerError)
+            return
+        }
+        resp.Redriven = len(done)
+    }
+    writeJSON(w, http.StatusOK, resp)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    _ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,118 @@
+package handler
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+
+    "github.com/yourname/dsproxy/pkg/cache"
+)
+
+// maxBatchRead bounds how many users one /read/batch request may ask for.
+const maxBatchRead = 1000
+
+type BatchReadReq struct {
+    UserIDs []string `json:"user_ids"`
+}
+
+type BatchReadResp struct {
+    Values   map[string]string `json:"values"`
+    NotFound []string          `json:"not_found"`
+}
+
+// readBatchHandler returns the latest value of several users. It takes
+// POST {"user_ids": [...]} or GET with repeated user_id parameters. Cache
+// hits are served from one pipelined lookup and the misses from a single
+// store query, which also refills the cache.
+func (h *Handler) readBatchHandler(w http.ResponseWriter, r *http.Request) {
+    ctx := r.Context()
+    var req BatchReadReq
+    switch r.Method {
+    case http.MethodGet:
+        req.UserIDs = r.URL.Query()["user_id"]
+    case http.MethodPost:
+        r.Body = http.MaxBytesReader(w, r.Body, maxBulkBody)
+        err := json.NewDecoder(r.Body).Decode(&req)
+        var tooLarge *http.MaxBytesError
+        if errors.As(err, &tooLarge) {
+            http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+            return
+        } else if err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+    default:
+        http.Error(w, "method", http.StatusMethodNotAllowed)
+        return
+    }
+    users := dedupe(req.UserIDs)
+    if len(users) == 0 {
+        http.Error(w, "missing user_id", http.StatusBadRequest)
+        return
+    }
+    if len(users) > maxBatchRead {
+        http.Error(w, fmt.Sprintf("more than %d user ids", maxBatchRead), http.StatusRequestEntityTooLarge)
+        return
+    }
+    for _, u := range users {
+        if forbidUser(w, r, u) {
+            return
+        }
+    }
+
+    resp := BatchReadResp{Values: make(map[string]string, len(users)), NotFound: []string{}}
+    // a cache error only means everything is read from the store
+    cached, _ := h.cache.GetMany(ctx, users)
+    var misses []string
+    for _, u := range users {
+        e, ok := cached[u]
+        switch {
+        case !ok:
+            misses = append(misses, u)
+        case e.Missing:
+            resp.NotFound = append(resp.NotFound, u)
+        default:
+            resp.Values[u] = e.Value
+        }
+    }
+
+    if len(misses) > 0 {
+        recs, err := h.db.GetLatestMany(ctx, misses)
+        if err != nil {
+            http.Error(w, "db error", http.StatusInternalServerError)
+            return
+        }
+        fill := make([]cache.KeyEntry, 0, len(recs))
+        var missing []string
+        for _, u := range misses {
+            rec, ok := recs[u]
+            if !ok {
+                resp.NotFound = append(resp.NotFound, u)
+                missing = append(missing, u)
+                continue
+            }
+            resp.Values[u] = rec.Value
+            fill = append(fill, cache.KeyEntry{Key: u, Entry: cache.Entry{Value: rec.Value, Ts: rec.Ts}})
+        }
+        // SetIfNewer so writes that landed meanwhile are not overwritten
+        _, _ = h.cache.SetManyIfNewer(ctx, fill)
+        if h.negativeTTL > 0 {
+            _ = h.cache.SetManyMissing(ctx, missing, h.negativeTTL)
+        }
+    }
+    writeJSON(w, http.StatusOK, resp)
+}
+
+// dedupe drops empty and repeated ids, keeping the first occurrence.
+func dedupe(ids []string) []string {
+    seen := make(map[string]bool, len(ids))
+    var out []string
+    for _, id := range ids {
+        if id != "" && !seen[id] {
+            seen[id] = true
+            out = append(out, id)
+        }
+    }
+    return out
+}
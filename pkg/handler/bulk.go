@@ -0,0 +1,299 @@
+package handler
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "mime"
+    "net/http"
+    "time"
+
+    "github.com/yourname/dsproxy/pkg/auth"
+    "github.com/yourname/dsproxy/pkg/batcher"
+    "github.com/yourname/dsproxy/pkg/cache"
+)
+
+const (
+    // maxBulkItems bounds how many records one /write/bulk request may carry.
+    maxBulkItems = 10000
+    // maxBulkLine bounds a single NDJSON line.
+    maxBulkLine = 1 << 20
+    // maxBulkBody bounds the whole request body, which a JSON array is
+    // read into at once.
+    maxBulkBody = 32 << 20
+
+    ndjsonType = "application/x-ndjson"
+)
+
+var (
+    errTooManyItems = fmt.Errorf("more than %d items", maxBulkItems)
+    errRateLimited  = errors.New("rate limit exceeded")
+)
+
+type BulkResult struct {
+    Index  int    `json:"index"`
+    Status string `json:"status"` // "accepted" or "rejected"
+    Error  string `json:"error,omitempty"`
+}
+
+type BulkResp struct {
+    Accepted int          `json:"accepted"`
+    Rejected int          `json:"rejected"`
+    Results  []BulkResult `json:"results"`
+}
+
+// bulkItem is one decoded element of a bulk body; err is set when the
+// element could not be decoded or failed validation.
+type bulkItem struct {
+    req WriteReq
+    err error
+}
+
+// writeBulkHandler accepts many records at once, either as a JSON array or
+// as newline-delimited JSON (Content-Type: application/x-ndjson). Invalid
+// items are rejected individually; the rest are enqueued like /write.
+func (h *Handler) writeBulkHandler(w http.ResponseWriter, r *http.Request) {
+    ctx := r.Context()
+    if r.Method != http.MethodPost {
+        http.Error(w, "method", http.StatusMethodNotAllowed)
+        return
+    }
+    r.Body = http.MaxBytesReader(w, r.Body, maxBulkBody)
+    items, err := decodeBulk(r)
+    var tooLarge *http.MaxBytesError
+    if errors.Is(err, errTooManyItems) || errors.As(err, &tooLarge) {
+        http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+        return
+    } else if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    // the key pays for the whole request, each user for their own items
+    if h.rateLimited(w, r, "", len(items)) {
+        return
+    }
+    limited := h.limitUsers(ctx, caller(r), items)
+    for i := range items {
+        it := &items[i]
+        if it.err == nil {
+            it.err = validateWrite(&it.req)
+        }
+        if it.err == nil && !auth.AllowUser(ctx, it.req.UserID) {
+            it.err = errors.New("user_id not allowed for this key")
+        }
+        if it.err == nil && limited[it.req.UserID] {
+            it.err = errRateLimited
+        }
+    }
+    tombs := h.tombstones(ctx, items)
+
+    now := time.Now().Unix()
+    resp := BulkResp{Results: make([]BulkResult, len(items))}
+    var entries []cache.KeyEntry
+    var clientTs []bool
+    queueFull := false
+    for i := range items {
+        it := &items[i]
+        res := &resp.Results[i]
+        res.Index = i
+        if it.err != nil {
+            res.Status, res.Error = "rejected", it.err.Error()
+            resp.Rejected++
+            continue
+        }
+        hasTs := it.req.Ts != 0
+        if !hasTs {
+            it.req.Ts = now
+        } else if tomb, ok := tombs[it.req.UserID]; ok && it.req.Ts < tomb {
+            res.Status, res.Error = "rejected", (&tombstonedError{ts: tomb}).Error()
+            resp.Rejected++
+            continue
+        }
+        if queueFull {
+            // later items would only wait for the same full queue
+            res.Status, res.Error = "rejected", "queue full"
+            resp.Rejected++
+            continue
+        }
+        if _, err := h.batcher.Enqueue(it.req.UserID, it.req.Value, it.req.Ts); err != nil {
+            res.Status, res.Error = "rejected", "enqueue error"
+            if errors.Is(err, batcher.ErrQueueFull) {
+                queueFull = true
+                res.Error = "queue full"
+            }
+            resp.Rejected++
+            continue
+        }
+        res.Status = "accepted"
+        resp.Accepted++
+        entries = append(entries, cache.KeyEntry{Key: it.req.UserID, Entry: cache.Entry{Value: it.req.Value, Ts: it.req.Ts}})
+        clientTs = append(clientTs, hasTs)
+    }
+
+    // one pipelined cache update for everything accepted
+    if len(entries) > 0 {
+        results, err := h.cache.SetManyIfNewer(ctx, entries)
+        if err == nil {
+            var created []cache.KeyEntry
+            for i, res := range results {
+                if res == cache.Created && clientTs[i] {
+                    created = append(created, entries[i])
+                }
+            }
+            h.reconcileMany(ctx, created)
+        }
+    }
+    if queueFull {
+        writeRetryAfter(w, time.Second)
+    }
+    writeJSON(w, http.StatusAccepted, resp)
+}
+
+// limitUsers charges every user's bucket for their items in one check and
+// returns the users over their rate, refunding their items to the caller's
+// key.
+func (h *Handler) limitUsers(ctx context.Context, caller string, items []bulkItem) map[string]bool {
+    if h.limits == nil {
+        return nil
+    }
+    counts := make(map[string]int)
+    for _, it := range items {
+        if it.err == nil && it.req.UserID != "" && auth.AllowUser(ctx, it.req.UserID) {
+            counts[it.req.UserID]++
+        }
+    }
+    limited := make(map[string]bool)
+    refund := 0
+    for user, n := range counts {
+        if !h.limits.Check(ctx, "", user, n).Allowed {
+            limited[user] = true
+            refund += n
+        }
+    }
+    // the key was charged for these items up front
+    h.limits.RefundKey(ctx, caller, refund)
+    return limited
+}
+
+// tombstones looks up, in one query, the tombstones of the users whose
+// items carry their own ts. If the lookup fails the writes go through, as
+// with checkTombstone.
+func (h *Handler) tombstones(ctx context.Context, items []bulkItem) map[string]int64 {
+    seen := make(map[string]bool)
+    var users []string
+    for _, it := range items {
+        if it.err == nil && it.req.Ts != 0 && !seen[it.req.UserID] {
+            seen[it.req.UserID] = true
+            users = append(users, it.req.UserID)
+        }
+    }
+    if len(users) == 0 {
+        return nil
+    }
+    tombs, err := h.db.Tombstones(ctx, users)
+    if err != nil {
+        return nil
+    }
+    return tombs
+}
+
+// reconcileMany is reconcileCache for several writes, with one store query.
+func (h *Handler) reconcileMany(ctx context.Context, written []cache.KeyEntry) {
+    if len(written) == 0 {
+        return
+    }
+    users := make([]string, 0, len(written))
+    for _, e := range written {
+        users = append(users, e.Key)
+    }
+    latest, err := h.db.GetLatestMany(ctx, users)
+    if err != nil {
+        return
+    }
+    var newer []cache.KeyEntry
+    for _, e := range written {
+        if rec, ok := latest[e.Key]; ok && rec.Ts > e.Entry.Ts {
+            newer = append(newer, cache.KeyEntry{Key: e.Key, Entry: cache.Entry{Value: rec.Value, Ts: rec.Ts}})
+        }
+    }
+    if len(newer) > 0 {
+        _, _ = h.cache.SetManyIfNewer(ctx, newer)
+    }
+}
+
+func validateWrite(req *WriteReq) error {
+    if req.UserID == "" {
+        return errors.New("missing user_id")
+    }
+    if req.Ts < 0 {
+        return errors.New("negative ts")
+    }
+    return nil
+}
+
+// decodeBulk reads the items of a bulk body. A malformed array fails the
+// whole request, while a malformed NDJSON line only rejects that item.
+func decodeBulk(r *http.Request) ([]bulkItem, error) {
+    ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+    br := bufio.NewReader(r.Body)
+    if ct != ndjsonType && firstByte(br) == '[' {
+        return decodeArray(br)
+    }
+    return decodeNDJSON(br)
+}
+
+// firstByte returns the first non-space byte of br without consuming it.
+func firstByte(br *bufio.Reader) byte {
+    for {
+        b, err := br.ReadByte()
+        if err != nil {
+            return 0
+        }
+        if b != ' ' && b != '\t' && b != '\r' && b != '\n' {
+            _ = br.UnreadByte()
+            return b
+        }
+    }
+}
+
+func decodeArray(rd io.Reader) ([]bulkItem, error) {
+    var raw []json.RawMessage
+    dec := json.NewDecoder(rd)
+    if err := dec.Decode(&raw); err != nil {
+        return nil, err
+    }
+    if len(raw) > maxBulkItems {
+        return nil, errTooManyItems
+    }
+    items := make([]bulkItem, len(raw))
+    for i, m := range raw {
+        items[i].err = json.Unmarshal(m, &items[i].req)
+    }
+    return items, nil
+}
+
+func decodeNDJSON(rd io.Reader) ([]bulkItem, error) {
+    var items []bulkItem
+    sc := bufio.NewScanner(rd)
+    sc.Buffer(make([]byte, 0, 64<<10), maxBulkLine)
+    for sc.Scan() {
+        line := bytes.TrimSpace(sc.Bytes())
+        if len(line) == 0 {
+            continue
+        }
+        if len(items) == maxBulkItems {
+            return nil, errTooManyItems
+        }
+        var it bulkItem
+        it.err = json.Unmarshal(line, &it.req)
+        items = append(items, it)
+    }
+    if err := sc.Err(); err != nil {
+        return nil, err
+    }
+    return items, nil
+}
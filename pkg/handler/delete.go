@@ -0,0 +1,108 @@
+package handler
+
+import (
+    "context"
+    "log"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/yourname/dsproxy/pkg/auth"
+)
+
+type DeleteResp struct {
+    UserID    string `json:"user_id"`
+    Tombstone int64  `json:"tombstone"`
+    Erased    bool   `json:"erased"`
+    // DroppedQueued counts accepted records that had not been flushed yet.
+    DroppedQueued      int `json:"dropped_queued"`
+    DeadLettersRemoved int `json:"dead_letters_removed"`
+}
+
+// deleteUserHandler serves DELETE /user/{id}. It drops the user's queued
+// records, removes its latest value from the store and the cache, and
+// records a tombstone at ?ts= (default now) so that writes with an older ts
+// are rejected. With ?erase=true, which needs the admin scope, the user's
+// history and dead letters are deleted too. A failure answers 5xx; the
+// delete is idempotent, so the client can retry.
+func (h *Handler) deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+    ctx := r.Context()
+    if r.Method != http.MethodDelete {
+        http.Error(w, "method", http.StatusMethodNotAllowed)
+        return
+    }
+    user := strings.TrimPrefix(r.URL.Path, "/user/")
+    if user == "" {
+        http.Error(w, "missing user_id", http.StatusBadRequest)
+        return
+    }
+    if forbidUser(w, r, user) {
+        return
+    }
+    params := r.URL.Query()
+    ts, err := queryInt(params, "ts", time.Now().Unix())
+    if err != nil {
+        http.Error(w, "invalid ts", http.StatusBadRequest)
+        return
+    }
+    var erase bool
+    if v := params.Get("erase"); v != "" {
+        if erase, err = strconv.ParseBool(v); err != nil {
+            http.Error(w, "invalid erase", http.StatusBadRequest)
+            return
+        }
+    }
+    if erase && !auth.AllowScope(ctx, auth.ScopeAdmin) {
+        http.Error(w, "erase requires scope admin", http.StatusForbidden)
+        return
+    }
+
+    resp := DeleteResp{UserID: user, Tombstone: ts, Erased: erase}
+    // queued records go first: they are being deleted either way, and a
+    // flush must not write them after the store delete
+    if resp.DroppedQueued, err = h.batcher.Drop(user); err != nil {
+        http.Error(w, "wal error", http.StatusInternalServerError)
+        return
+    }
+    if err := h.db.DeleteUser(ctx, user, ts, erase); err != nil {
+        http.Error(w, "db error", http.StatusInternalServerError)
+        return
+    }
+    // a tombstone rather than a plain delete, so a read that loaded the
+    // old value before the delete cannot put it back
+    if err := h.cache.SetDeleted(ctx, user, ts); err != nil {
+        // the old value would be served until its TTL runs out
+        log.Printf("delete %s: cache error: %v", user, err)
+        http.Error(w, "cache error", http.StatusInternalServerError)
+        return
+    }
+    if erase && h.deadLetter != nil {
+        removed, err := h.deadLetter.RemoveUser(ctx, user)
+        if err != nil {
+            http.Error(w, "dead-letter error", http.StatusInternalServerError)
+            return
+        }
+        resp.DeadLettersRemoved = len(removed)
+    }
+    writeJSON(w, http.StatusOK, resp)
+}
+
+// checkTombstone rejects a write with a client-supplied ts older than the
+// user's deletion; writes stamped by the proxy are never older. If the
+// lookup fails the write goes through and InsertBatch drops it if needed.
+func (h *Handler) checkTombstone(ctx context.Context, user string, ts int64) error {
+    tomb, err := h.db.Tombstone(ctx, user)
+    if err != nil || ts >= tomb {
+        return nil
+    }
+    return &tombstonedError{ts: tomb}
+}
+
+type tombstonedError struct {
+    ts int64
+}
+
+func (e *tombstonedError) Error() string {
+    return "user was deleted at ts " + strconv.FormatInt(e.ts, 10)
+}
@@ -1,36 +1,157 @@
 package handler
 
 import (
-    // "context"
+    "context"
     "encoding/json"
+    "errors"
+    "math"
     "net/http"
+    "strconv"
     "time"
 
-    "github.com/jackc/pgx/v5"
+    "github.com/yourname/dsproxy/pkg/auth"
     "github.com/yourname/dsproxy/pkg/cache"
     "github.com/yourname/dsproxy/pkg/db"
     "github.com/yourname/dsproxy/pkg/batcher"
+    "github.com/yourname/dsproxy/pkg/deadletter"
+    "github.com/yourname/dsproxy/pkg/ratelimit"
     "github.com/prometheus/client_golang/prometheus/promhttp"
+    "golang.org/x/sync/singleflight"
+)
+
+const (
+    durableHeader       = "X-Durable-Write"
+    durableWriteTimeout = 30 * time.Second
+    readThroughTimeout  = 5 * time.Second
+
+    defaultNegativeTTL = 30 * time.Second
 )
 
 type Handler struct {
-    db      *db.DB
-    cache   *cache.Cache
-    batcher *batcher.Batcher
+    db          db.Store
+    cache       cache.Cache
+    batcher     *batcher.Batcher
+    deadLetter  *deadletter.File
+    negativeTTL time.Duration
+    auth        *auth.Authenticator
+    limits      *ratelimit.Policy
+    ready       ReadyConfig
+    storeDown   downtime
+
+    loads singleflight.Group // coalesces concurrent cache-miss reads per user
+}
+
+type Option func(*Handler)
+
+// WithDeadLetter enables the /admin/deadletter endpoints.
+func WithDeadLetter(d *deadletter.File) Option {
+    return func(h *Handler) { h.deadLetter = d }
+}
+
+// WithNegativeTTL sets how long a /read miss for an unknown user is cached.
+// Zero disables negative caching.
+func WithNegativeTTL(ttl time.Duration) Option {
+    return func(h *Handler) { h.negativeTTL = ttl }
 }
 
-func New(d *db.DB, c *cache.Cache, b *batcher.Batcher) *Handler {
-    return &Handler{db: d, cache: c, batcher: b}
+// WithAuth requires a key with the matching scope on every route and
+// restricts keys to their user_id prefix.
+func WithAuth(a *auth.Authenticator) Option {
+    return func(h *Handler) { h.auth = a }
+}
+
+// WithRateLimit limits writes per API key and per user_id.
+func WithRateLimit(p *ratelimit.Policy) Option {
+    return func(h *Handler) { h.limits = p }
+}
+
+// WithReadiness overrides DefaultReadyConfig.
+func WithReadiness(c ReadyConfig) Option {
+    return func(h *Handler) { h.ready = c }
+}
+
+func New(d db.Store, c cache.Cache, b *batcher.Batcher, opts ...Option) *Handler {
+    h := &Handler{db: d, cache: c, batcher: b, negativeTTL: defaultNegativeTTL, ready: DefaultReadyConfig}
+    for _, opt := range opts {
+        opt(h)
+    }
+    return h
 }
 
 func (h *Handler) Routes() http.Handler {
     mux := http.NewServeMux()
-    mux.HandleFunc("/write", h.writeHandler)
-    mux.HandleFunc("/read", h.readHandler)
-    mux.Handle("/metrics", promhttp.Handler())
+    // probes come from the orchestrator, which has no key
+    mux.HandleFunc("/healthz", h.healthzHandler)
+    mux.HandleFunc("/readyz", h.readyzHandler)
+    h.handle(mux, "/write", auth.ScopeWrite, http.HandlerFunc(h.writeHandler))
+    h.handle(mux, "/write/bulk", auth.ScopeWrite, http.HandlerFunc(h.writeBulkHandler))
+    h.handle(mux, "/read", auth.ScopeRead, http.HandlerFunc(h.readHandler))
+    h.handle(mux, "/read/batch", auth.ScopeRead, http.HandlerFunc(h.readBatchHandler))
+    h.handle(mux, "/history", auth.ScopeRead, http.HandlerFunc(h.historyHandler))
+    h.handle(mux, "/user/", auth.ScopeWrite, http.HandlerFunc(h.deleteUserHandler))
+    h.handle(mux, "/metrics", auth.ScopeMetrics, promhttp.Handler())
+    if h.deadLetter != nil {
+        h.handle(mux, "/admin/deadletter", auth.ScopeAdmin, http.HandlerFunc(h.deadLetterListHandler))
+        h.handle(mux, "/admin/deadletter/redrive", auth.ScopeAdmin, http.HandlerFunc(h.deadLetterRedriveHandler))
+    }
     return mux
 }
 
+// handle registers next for pattern, requiring scope when auth is enabled.
+func (h *Handler) handle(mux *http.ServeMux, pattern string, scope auth.Scope, next http.Handler) {
+    if h.auth != nil {
+        next = h.auth.Require(scope, next)
+    }
+    mux.Handle(pattern, next)
+}
+
+// forbidUser answers 403 and returns true if the caller's key may not
+// access user's data.
+func forbidUser(w http.ResponseWriter, r *http.Request, user string) bool {
+    if auth.AllowUser(r.Context(), user) {
+        return false
+    }
+    http.Error(w, "user_id not allowed for this key", http.StatusForbidden)
+    return true
+}
+
+// rateLimited answers 429 and returns true if the caller or user is over
+// their write rate. cost is the number of records written.
+func (h *Handler) rateLimited(w http.ResponseWriter, r *http.Request, user string, cost int) bool {
+    if h.limits == nil {
+        return false
+    }
+    d := h.limits.Check(r.Context(), caller(r), user, cost)
+    if d.Allowed {
+        return false
+    }
+    writeRetryAfter(w, d.RetryAfter)
+    http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+    return true
+}
+
+// caller names the rate limit bucket of the request's API key or token.
+// Keys are told apart by KeyID, as two keys may share a name.
+func caller(r *http.Request) string {
+    p, ok := auth.FromContext(r.Context())
+    if !ok {
+        return ""
+    }
+    if p.UserID != "" {
+        return "jwt:" + p.UserID
+    }
+    return p.KeyID
+}
+
+// writeRetryAfter sets Retry-After in whole seconds, rounded up.
+func writeRetryAfter(w http.ResponseWriter, d time.Duration) {
+    secs := int(math.Ceil(d.Seconds()))
+    if secs < 1 {
+        secs = 1
+    }
+    w.Header().Set("Retry-After", strconv.Itoa(secs))
+}
+
 type WriteReq struct {
     UserID string `json:"user_id"`
     Value  string `json:"value"`
@@ -48,18 +169,88 @@ func (h *Handler) writeHandler(w http.ResponseWriter, r *http.Request) {
         http.Error(w, err.Error(), http.StatusBadRequest)
         return
     }
-    if req.Ts == 0 {
+    if forbidUser(w, r, req.UserID) || h.rateLimited(w, r, req.UserID, 1) {
+        return
+    }
+    clientTs := req.Ts != 0
+    if !clientTs {
         req.Ts = time.Now().Unix()
+    } else if err := h.checkTombstone(ctx, req.UserID, req.Ts); err != nil {
+        http.Error(w, err.Error(), http.StatusConflict)
+        return
     }
 
-    // write-through to cache
-    _ = h.cache.Set(ctx, req.UserID, req.Value)
+    // enqueue to batcher; once this returns the write is durable in the WAL
+    fut, err := h.batcher.Enqueue(req.UserID, req.Value, req.Ts)
+    if errors.Is(err, batcher.ErrQueueFull) {
+        // the store is not keeping up; the client should back off
+        writeRetryAfter(w, time.Second)
+        http.Error(w, "queue full", http.StatusServiceUnavailable)
+        return
+    } else if err != nil {
+        http.Error(w, "enqueue error", http.StatusInternalServerError)
+        return
+    }
 
-    // enqueue to batcher
-    h.batcher.Enqueue(req.UserID, req.Value, req.Ts)
+    // write-through to cache, unless it already holds a newer write
+    res, err := h.cache.SetIfNewer(ctx, req.UserID, cache.Entry{Value: req.Value, Ts: req.Ts})
+    if err == nil && res == cache.Created && clientTs {
+        h.reconcileCache(ctx, req.UserID, req.Ts)
+    }
 
-    w.WriteHeader(http.StatusAccepted)
-    _, _ = w.Write([]byte("accepted"))
+    if !durableRequested(r) {
+        w.WriteHeader(http.StatusAccepted)
+        _, _ = w.Write([]byte("accepted"))
+        return
+    }
+
+    // durable mode: wait for the batch holding this record to commit
+    waitCtx, cancel := context.WithTimeout(ctx, durableWriteTimeout)
+    defer cancel()
+    if err := fut.Wait(waitCtx); err != nil {
+        writeDurableError(w, err)
+        return
+    }
+    w.WriteHeader(http.StatusCreated)
+    _, _ = w.Write([]byte("committed"))
+}
+
+// reconcileCache handles a write with a client-supplied ts that found the
+// cache empty: the store may hold a newer record whose cache entry expired,
+// in which case that record must win.
+func (h *Handler) reconcileCache(ctx context.Context, user string, ts int64) {
+    rec, err := h.db.GetLatest(ctx, user)
+    if err != nil || rec.Ts <= ts {
+        return
+    }
+    _, _ = h.cache.SetIfNewer(ctx, user, cache.Entry{Value: rec.Value, Ts: rec.Ts})
+}
+
+// durableRequested reports whether the client opted into waiting for the
+// database commit via ?durable=true or the X-Durable-Write header.
+func durableRequested(r *http.Request) bool {
+    v := r.URL.Query().Get("durable")
+    if v == "" {
+        v = r.Header.Get(durableHeader)
+    }
+    ok, _ := strconv.ParseBool(v)
+    return ok
+}
+
+func writeDurableError(w http.ResponseWriter, err error) {
+    var dl *batcher.DeadLetterError
+    switch {
+    case errors.As(err, &dl):
+        http.Error(w, dl.Error(), http.StatusUnprocessableEntity)
+    case errors.Is(err, batcher.ErrDropped):
+        // the user was deleted while the record was queued
+        http.Error(w, "record dropped", http.StatusConflict)
+    case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+        // the record is still queued and will be written eventually
+        http.Error(w, "commit pending", http.StatusGatewayTimeout)
+    default:
+        http.Error(w, "commit error", http.StatusInternalServerError)
+    }
 }
 
 func (h *Handler) readHandler(w http.ResponseWriter, r *http.Request) {
@@ -69,16 +260,27 @@ func (h *Handler) readHandler(w http.ResponseWriter, r *http.Request) {
         http.Error(w, "missing user_id", http.StatusBadRequest)
         return
     }
-    // check cache first
-    if val, err := h.cache.Get(ctx, user); err == nil && val != "" {
+    if forbidUser(w, r, user) {
+        return
+    }
+    if r.URL.Query().Has("as_of") {
+        h.readAsOf(w, r, user)
+        return
+    }
+    // check cache first; a negative entry means the store had nothing
+    if e, err := h.cache.GetEntry(ctx, user); err == nil {
+        if e.Missing {
+            http.Error(w, "not found", http.StatusNotFound)
+            return
+        }
         w.WriteHeader(http.StatusOK)
-        _, _ = w.Write([]byte(val))
+        _, _ = w.Write([]byte(e.Value))
         return
     }
 
-    // fallback to DB
-    rec, err := h.db.GetLatest(ctx, user)
-    if err == pgx.ErrNoRows {
+    // fallback to DB, populating the cache on the way back
+    rec, err := h.loadLatest(ctx, user)
+    if errors.Is(err, db.ErrNotFound) {
         http.Error(w, "not found", http.StatusNotFound)
         return
     } else if err != nil {
@@ -88,3 +290,29 @@ func (h *Handler) readHandler(w http.ResponseWriter, r *http.Request) {
     w.WriteHeader(http.StatusOK)
     _, _ = w.Write([]byte(rec.Value))
 }
+
+// loadLatest reads user's latest record from the store and writes it back to
+// the cache, or a negative entry if there is none. Concurrent misses for the
+// same user share one store query. The query is detached from the caller's
+// cancellation since other requests may be waiting on it.
+func (h *Handler) loadLatest(ctx context.Context, user string) (*db.Record, error) {
+    v, err, _ := h.loads.Do(user, func() (interface{}, error) {
+        ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), readThroughTimeout)
+        defer cancel()
+        rec, err := h.db.GetLatest(ctx, user)
+        if errors.Is(err, db.ErrNotFound) && h.negativeTTL > 0 {
+            // the next write for user replaces the marker
+            _ = h.cache.SetMissing(ctx, user, h.negativeTTL)
+        }
+        if err != nil {
+            return nil, err
+        }
+        // SetIfNewer so a write that landed meanwhile is not overwritten
+        _, _ = h.cache.SetIfNewer(ctx, user, cache.Entry{Value: rec.Value, Ts: rec.Ts})
+        return rec, nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    return v.(*db.Record), nil
+}
@@ -0,0 +1,177 @@
+package handler
+
+import (
+    "context"
+    "fmt"
+    "net/http"
+    "sync"
+    "time"
+
+    "github.com/yourname/dsproxy/pkg/db"
+)
+
+// pingTimeout bounds each dependency check of /readyz.
+const pingTimeout = 2 * time.Second
+
+// ReadyConfig sets when /readyz reports the proxy unavailable.
+type ReadyConfig struct {
+    // MaxQueue is the batcher queue depth above which the proxy is not
+    // ready; 0 disables the check.
+    MaxQueue int
+    // MaxStoreDown is how long the store may fail its checks before the
+    // proxy is not ready. Writes are buffered meanwhile, so short outages
+    // do not take it out of rotation.
+    MaxStoreDown time.Duration
+}
+
+var DefaultReadyConfig = ReadyConfig{
+    MaxQueue:     10000,
+    MaxStoreDown: 30 * time.Second,
+}
+
+// Check statuses. Only "failing" makes the proxy unavailable.
+const (
+    statusOK       = "ok"
+    statusDegraded = "degraded"
+    statusFailing  = "failing"
+)
+
+type healthResp struct {
+    Status  string         `json:"status"` // "ok" or "unavailable"
+    Store   *storeHealth   `json:"store,omitempty"`
+    Cache   *cacheHealth   `json:"cache,omitempty"`
+    Batcher *batcherHealth `json:"batcher,omitempty"`
+}
+
+type storeHealth struct {
+    Status      string        `json:"status"`
+    Error       string        `json:"error,omitempty"`
+    DownSeconds float64       `json:"down_seconds,omitempty"`
+    Pool        *db.PoolStats `json:"pool,omitempty"`
+}
+
+type cacheHealth struct {
+    Status string `json:"status"`
+    Error  string `json:"error,omitempty"`
+}
+
+type batcherHealth struct {
+    Status              string  `json:"status"`
+    QueueDepth          int     `json:"queue_depth"`
+    QueueBytes          int64   `json:"queue_bytes"`
+    Spilled             int     `json:"spilled"`
+    LastFlushAgeSeconds float64 `json:"last_flush_age_seconds"`
+}
+
+// downtime tracks since when a dependency has been failing its checks.
+type downtime struct {
+    mu    sync.Mutex
+    since time.Time
+}
+
+// observe records the outcome of a check and returns how long the
+// dependency has been down.
+func (d *downtime) observe(err error, now time.Time) time.Duration {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    if err == nil {
+        d.since = time.Time{}
+        return 0
+    }
+    if d.since.IsZero() {
+        d.since = now
+    }
+    return now.Sub(d.since)
+}
+
+// healthzHandler is the liveness probe: it answers as long as the process
+// serves HTTP and does not check dependencies, so that an outage of
+// Postgres or Redis does not get every instance restarted.
+func (h *Handler) healthzHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet && r.Method != http.MethodHead {
+        http.Error(w, "method", http.StatusMethodNotAllowed)
+        return
+    }
+    writeHealth(w, r, http.StatusOK, healthResp{Status: statusOK})
+}
+
+// readyzHandler is the readiness probe. It answers 503 when the queue is
+// over its threshold or the store has been unreachable for too long.
+func (h *Handler) readyzHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet && r.Method != http.MethodHead {
+        http.Error(w, "method", http.StatusMethodNotAllowed)
+        return
+    }
+    resp := h.checkReady(r.Context())
+    status := http.StatusOK
+    if resp.Status != statusOK {
+        status = http.StatusServiceUnavailable
+    }
+    writeHealth(w, r, status, resp)
+}
+
+// writeHealth answers with the bare status, or the whole report as JSON
+// when the request has a verbose parameter.
+func writeHealth(w http.ResponseWriter, r *http.Request, status int, resp healthResp) {
+    w.Header().Set("Cache-Control", "no-store")
+    if r.URL.Query().Has("verbose") {
+        writeJSON(w, status, resp)
+        return
+    }
+    w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+    w.WriteHeader(status)
+    fmt.Fprintln(w, resp.Status)
+}
+
+func (h *Handler) checkReady(ctx context.Context) healthResp {
+    ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+    defer cancel()
+
+    var storeErr, cacheErr error
+    var wg sync.WaitGroup
+    wg.Add(2)
+    go func() {
+        defer wg.Done()
+        storeErr = h.db.Ping(ctx)
+    }()
+    go func() {
+        defer wg.Done()
+        cacheErr = h.cache.Ping(ctx)
+    }()
+    wg.Wait()
+    now := time.Now()
+
+    resp := healthResp{
+        Status:  statusOK,
+        Store:   &storeHealth{Status: statusOK},
+        Cache:   &cacheHealth{Status: statusOK},
+        Batcher: &batcherHealth{Status: statusOK},
+    }
+    if pg, ok := h.db.(*db.DB); ok {
+        stats := pg.PoolStats()
+        resp.Store.Pool = &stats
+    }
+    if down := h.storeDown.observe(storeErr, now); storeErr != nil {
+        resp.Store.Status, resp.Store.Error = statusDegraded, storeErr.Error()
+        resp.Store.DownSeconds = down.Seconds()
+        if down >= h.ready.MaxStoreDown {
+            resp.Store.Status = statusFailing
+        }
+    }
+    // reads fall through to the store, so the cache alone never fails
+    if cacheErr != nil {
+        resp.Cache.Status, resp.Cache.Error = statusDegraded, cacheErr.Error()
+    }
+    stats := h.batcher.Stats()
+    resp.Batcher.QueueDepth = stats.Pending
+    resp.Batcher.QueueBytes = stats.PendingBytes
+    resp.Batcher.Spilled = stats.Spilled
+    resp.Batcher.LastFlushAgeSeconds = now.Sub(stats.LastFlush).Seconds()
+    if h.ready.MaxQueue > 0 && stats.Pending+stats.Spilled > h.ready.MaxQueue {
+        resp.Batcher.Status = statusFailing
+    }
+    if resp.Store.Status == statusFailing || resp.Batcher.Status == statusFailing {
+        resp.Status = "unavailable"
+    }
+    return resp
+}
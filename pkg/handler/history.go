@@ -0,0 +1,83 @@
+package handler
+
+import (
+    "errors"
+    "net/http"
+    "net/url"
+    "strconv"
+
+    "github.com/yourname/dsproxy/pkg/db"
+)
+
+// historyHandler lists a user's writes in (ts, insertion) order, one page at
+// a time. Pass next_cursor from the response as cursor to get the next page.
+func (h *Handler) historyHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "method", http.StatusMethodNotAllowed)
+        return
+    }
+    params := r.URL.Query()
+    q := db.NewHistoryQuery(params.Get("user_id"))
+    if q.UserID == "" {
+        http.Error(w, "missing user_id", http.StatusBadRequest)
+        return
+    }
+    if forbidUser(w, r, q.UserID) {
+        return
+    }
+    var err error
+    if q.From, err = queryInt(params, "from", q.From); err != nil {
+        http.Error(w, "invalid from", http.StatusBadRequest)
+        return
+    }
+    if q.To, err = queryInt(params, "to", q.To); err != nil {
+        http.Error(w, "invalid to", http.StatusBadRequest)
+        return
+    }
+    limit, err := queryInt(params, "limit", int64(q.Limit))
+    if err != nil || limit < 0 {
+        http.Error(w, "invalid limit", http.StatusBadRequest)
+        return
+    }
+    q.Limit = int(limit)
+    q.Cursor = params.Get("cursor")
+
+    page, err := h.db.History(r.Context(), q)
+    if errors.Is(err, db.ErrInvalidCursor) {
+        http.Error(w, "invalid cursor", http.StatusBadRequest)
+        return
+    } else if err != nil {
+        http.Error(w, "db error", http.StatusInternalServerError)
+        return
+    }
+    writeJSON(w, http.StatusOK, page)
+}
+
+// readAsOf serves /read?as_of=ts from the store; the cache only holds the
+// latest value.
+func (h *Handler) readAsOf(w http.ResponseWriter, r *http.Request, user string) {
+    asOf, err := strconv.ParseInt(r.URL.Query().Get("as_of"), 10, 64)
+    if err != nil {
+        http.Error(w, "invalid as_of", http.StatusBadRequest)
+        return
+    }
+    rec, err := h.db.GetAsOf(r.Context(), user, asOf)
+    if errors.Is(err, db.ErrNotFound) {
+        http.Error(w, "not found", http.StatusNotFound)
+        return
+    } else if err != nil {
+        http.Error(w, "db error", http.StatusInternalServerError)
+        return
+    }
+    w.WriteHeader(http.StatusOK)
+    _, _ = w.Write([]byte(rec.Value))
+}
+
+// queryInt parses the named query parameter, returning def when it is absent.
+func queryInt(params url.Values, name string, def int64) (int64, error) {
+    v := params.Get(name)
+    if v == "" {
+        return def, nil
+    }
+    return strconv.ParseInt(v, 10, 64)
+}
@@ -0,0 +1,85 @@
+// Package prefix resolves per-namespace settings by longest matching key
+// prefix, and parses the prefix=spec lists they are configured with.
+package prefix
+
+import (
+    "fmt"
+    "sort"
+    "strings"
+)
+
+// Table resolves the value for a key by longest matching prefix.
+type Table[T any] struct {
+    def  T
+    list []entry[T] // longest prefix first
+}
+
+type entry[T any] struct {
+    prefix string
+    val    T
+}
+
+// New returns a Table of vals, keyed by what prefixOf returns for each. It
+// falls back to def when no prefix matches; a value with an empty prefix
+// replaces def.
+func New[T any](def T, prefixOf func(T) string, vals ...T) *Table[T] {
+    t := &Table[T]{def: def}
+    for _, v := range vals {
+        p := prefixOf(v)
+        if p == "" {
+            t.def = v
+            continue
+        }
+        t.list = append(t.list, entry[T]{prefix: p, val: v})
+    }
+    sort.SliceStable(t.list, func(i, j int) bool {
+        return len(t.list[i].prefix) > len(t.list[j].prefix)
+    })
+    return t
+}
+
+func (t *Table[T]) For(key string) T {
+    for _, e := range t.list {
+        if strings.HasPrefix(key, e.prefix) {
+            return e.val
+        }
+    }
+    return t.def
+}
+
+// Map returns a Table with f applied to the default and every value, under
+// the same prefixes.
+func (t *Table[T]) Map(f func(T) T) *Table[T] {
+    out := &Table[T]{def: f(t.def), list: make([]entry[T], len(t.list))}
+    for i, e := range t.list {
+        out.list[i] = entry[T]{prefix: e.prefix, val: f(e.val)}
+    }
+    return out
+}
+
+// ParseList parses a comma-separated list of prefix=spec entries, calling
+// parse for each. The prefix "*" is passed as "", i.e. the default. what
+// names an entry in errors, e.g. "cache policy".
+func ParseList[T any](s, what string, parse func(prefix, spec string) (T, error)) ([]T, error) {
+    var out []T
+    for _, part := range strings.Split(s, ",") {
+        part = strings.TrimSpace(part)
+        if part == "" {
+            continue
+        }
+        i := strings.LastIndex(part, "=")
+        if i < 0 {
+            return nil, fmt.Errorf("%s %q: missing '='", what, part)
+        }
+        p := part[:i]
+        if p == "*" {
+            p = ""
+        }
+        v, err := parse(p, part[i+1:])
+        if err != nil {
+            return nil, fmt.Errorf("%s %q: %w", what, part, err)
+        }
+        out = append(out, v)
+    }
+    return out, nil
+}
@@ -0,0 +1,83 @@
+package prefix
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+type setting struct {
+	prefix string
+	val    int
+}
+
+func settingPrefix(s setting) string { return s.prefix }
+
+func TestTable_For(t *testing.T) {
+	tbl := New(setting{val: -1}, settingPrefix,
+		setting{"a:", 1},
+		setting{"a:b:", 2},
+		setting{"c:", 3},
+	)
+	tests := []struct {
+		key  string
+		want int
+	}{
+		{"a:x", 1},
+		{"a:b:x", 2},
+		{"c:", 3},
+		{"b:x", -1},
+		{"", -1},
+	}
+	for _, tt := range tests {
+		if got := tbl.For(tt.key).val; got != tt.want {
+			t.Errorf("For(%q) = %d, want %d", tt.key, got, tt.want)
+		}
+	}
+
+	if got := New(setting{val: -1}, settingPrefix, setting{"", 9}).For("x").val; got != 9 {
+		t.Errorf("For() with an empty-prefix value = %d, want 9", got)
+	}
+}
+
+func TestTable_Map(t *testing.T) {
+	tbl := New(setting{val: 1}, settingPrefix, setting{"a:", 2}).Map(func(s setting) setting {
+		s.val *= 10
+		return s
+	})
+	if got := tbl.For("a:x").val; got != 20 {
+		t.Errorf("For(a:x) after Map = %d, want 20", got)
+	}
+	if got := tbl.For("b").val; got != 10 {
+		t.Errorf("For(b) after Map = %d, want 10", got)
+	}
+}
+
+func TestParseList(t *testing.T) {
+	parse := func(p, spec string) (setting, error) {
+		if spec == "bad" {
+			return setting{}, errors.New("bad spec")
+		}
+		return setting{prefix: p, val: len(spec)}, nil
+	}
+	tests := []struct {
+		in      string
+		want    []setting
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"*=xx, a:=x,", []setting{{"", 2}, {"a:", 1}}, false},
+		{"a=b=ccc", []setting{{"a=b", 3}}, false},
+		{"a:", nil, true},
+		{"a:=bad", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseList(tt.in, "setting", parse)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("ParseList(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("ParseList(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
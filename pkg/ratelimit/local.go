@@ -0,0 +1,79 @@
+package ratelimit
+
+import (
+    "context"
+    "math"
+    "sync"
+    "time"
+)
+
+// maxLocalBuckets is how many buckets Local holds before it drops the full
+// ones, which behave the same as absent ones.
+const maxLocalBuckets = 100000
+
+// Local keeps buckets in process memory.
+type Local struct {
+    mu      sync.Mutex
+    buckets map[string]*bucket
+    now     func() time.Time
+}
+
+var _ Limiter = (*Local)(nil)
+
+type bucket struct {
+    tokens float64
+    last   time.Time
+    full   time.Time // when the bucket is refilled completely
+}
+
+func NewLocal() *Local {
+    return &Local{buckets: make(map[string]*bucket), now: time.Now}
+}
+
+func (lc *Local) Allow(ctx context.Context, key string, l Limit, cost int) Decision {
+    lc.mu.Lock()
+    defer lc.mu.Unlock()
+    now := lc.now()
+    burst := float64(l.burst())
+    b, ok := lc.buckets[key]
+    if !ok {
+        if len(lc.buckets) >= maxLocalBuckets {
+            lc.sweep(now)
+        }
+        b = &bucket{tokens: burst, last: now}
+        lc.buckets[key] = b
+    }
+    if elapsed := now.Sub(b.last); elapsed > 0 {
+        b.tokens = math.Min(burst, b.tokens+elapsed.Seconds()*l.Rate)
+        b.last = now
+    }
+    d := Decision{}
+    if b.tokens >= float64(cost) {
+        b.tokens -= float64(cost)
+        d.Allowed = true
+    } else {
+        d.RetryAfter = time.Duration(math.Ceil((float64(cost) - b.tokens) / l.Rate * float64(time.Second)))
+    }
+    d.Remaining = int(b.tokens)
+    b.full = now.Add(time.Duration((burst - b.tokens) / l.Rate * float64(time.Second)))
+    return d
+}
+
+func (lc *Local) Refund(ctx context.Context, key string, l Limit, cost int) {
+    lc.mu.Lock()
+    defer lc.mu.Unlock()
+    b, ok := lc.buckets[key]
+    if !ok {
+        return
+    }
+    b.tokens = math.Min(float64(l.burst()), b.tokens+float64(cost))
+    b.full = b.last.Add(time.Duration((float64(l.burst()) - b.tokens) / l.Rate * float64(time.Second)))
+}
+
+func (lc *Local) sweep(now time.Time) {
+    for key, b := range lc.buckets {
+        if !now.Before(b.full) {
+            delete(lc.buckets, key)
+        }
+    }
+}
@@ -0,0 +1,208 @@
+// Package ratelimit implements token-bucket rate limits shared by all
+// instances through Redis, with an in-process fallback.
+package ratelimit
+
+import (
+    "context"
+    "log"
+    "math"
+    "sync/atomic"
+    "time"
+
+    "github.com/go-redis/redis/v8"
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+    decisionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+        Name: "dsproxy_ratelimit_decisions_total",
+        Help: "Rate limit checks by limit (key, user) and decision (allowed, limited).",
+    }, []string{"limit", "decision"})
+    fallbackTotal = promauto.NewCounter(prometheus.CounterOpts{
+        Name: "dsproxy_ratelimit_fallback_total",
+        Help: "Checks decided in-process because Redis was unavailable.",
+    })
+)
+
+// Limit is a token bucket refilled at Rate tokens per second and holding at
+// most Burst tokens. A zero Rate disables the limit.
+type Limit struct {
+    Rate  float64
+    Burst int
+}
+
+func (l Limit) Enabled() bool {
+    return l.Rate > 0
+}
+
+// burst defaults to one second's worth of tokens.
+func (l Limit) burst() int {
+    if l.Burst > 0 {
+        return l.Burst
+    }
+    return int(math.Max(1, math.Ceil(l.Rate)))
+}
+
+// Decision is the outcome of taking tokens from a bucket.
+type Decision struct {
+    Allowed   bool
+    Remaining int
+    // RetryAfter is how long until the request would be allowed.
+    RetryAfter time.Duration
+}
+
+// Limiter takes tokens from named buckets. Implementations fail open: a
+// backend error never turns into a rejected request.
+type Limiter interface {
+    Allow(ctx context.Context, key string, l Limit, cost int) Decision
+    // Refund gives back cost tokens taken by an allowed Allow, up to the
+    // burst.
+    Refund(ctx context.Context, key string, l Limit, cost int)
+}
+
+// Policy applies a per-API-key and a per-user_id limit on top of a Limiter.
+type Policy struct {
+    Limiter Limiter
+    PerKey  Limit
+    PerUser Limit
+}
+
+// Check charges cost tokens to the caller's key bucket and to the user's
+// bucket, or to neither: if the user's bucket refuses, the key's tokens are
+// refunded. An empty caller or user skips that limit. A cost above a
+// limit's burst is charged as the full burst, so big requests are slowed
+// down rather than rejected forever.
+func (p *Policy) Check(ctx context.Context, caller, user string, cost int) Decision {
+    d := Decision{Allowed: true}
+    charged := false
+    if caller != "" && p.PerKey.Enabled() {
+        d = p.take(ctx, "key", "key:"+caller, p.PerKey, cost)
+        if !d.Allowed {
+            return d
+        }
+        charged = true
+    }
+    if user != "" && p.PerUser.Enabled() {
+        d = p.take(ctx, "user", "user:"+user, p.PerUser, cost)
+        if !d.Allowed && charged {
+            p.RefundKey(ctx, caller, cost)
+        }
+    }
+    return d
+}
+
+// RefundKey gives cost tokens back to the caller's key bucket, for records
+// Check charged that were refused afterwards.
+func (p *Policy) RefundKey(ctx context.Context, caller string, cost int) {
+    if caller == "" || cost <= 0 || !p.PerKey.Enabled() {
+        return
+    }
+    p.Limiter.Refund(ctx, "key:"+caller, p.PerKey, min(cost, p.PerKey.burst()))
+}
+
+func (p *Policy) take(ctx context.Context, limit, key string, l Limit, cost int) Decision {
+    cost = min(cost, l.burst())
+    d := p.Limiter.Allow(ctx, key, l, cost)
+    if d.Allowed {
+        decisionsTotal.WithLabelValues(limit, "allowed").Inc()
+    } else {
+        decisionsTotal.WithLabelValues(limit, "limited").Inc()
+    }
+    return d
+}
+
+// takeScript refills the bucket in KEYS[1] by elapsed time and takes
+// ARGV[3] tokens if it holds enough. It uses the Redis clock so instances
+// with skewed clocks share buckets fairly. Returns {allowed, remaining,
+// retry after in microseconds}.
+var takeScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local cost = tonumber(ARGV[3])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local b = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(b[1])
+local ts = tonumber(b[2])
+if tokens == nil or ts == nil then
+    tokens = burst
+    ts = now
+end
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate / 1000000)
+local allowed = 0
+local wait = 0
+if tokens >= cost then
+    tokens = tokens - cost
+    allowed = 1
+else
+    wait = math.ceil((cost - tokens) * 1000000 / rate)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst * 1000 / rate) + 1000)
+return {allowed, math.floor(tokens), wait}
+`)
+
+// refundScript adds ARGV[2] tokens back to the bucket in KEYS[1], up to
+// ARGV[1]. A bucket that expired meanwhile is full already.
+var refundScript = redis.NewScript(`
+local burst = tonumber(ARGV[1])
+local tokens = tonumber(redis.call('HGET', KEYS[1], 'tokens'))
+if tokens == nil then
+    return 0
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(math.min(burst, tokens + tonumber(ARGV[2]))))
+return 1
+`)
+
+const keyPrefix = "ratelimit:"
+
+// Redis keeps buckets in Redis so that limits hold across instances. While
+// Redis is unreachable, buckets are kept per instance instead.
+type Redis struct {
+    client   *redis.Client
+    fallback *Local
+    failing  atomic.Bool
+}
+
+var _ Limiter = (*Redis)(nil)
+
+func NewRedis(addr string) *Redis {
+    return &Redis{
+        client:   redis.NewClient(&redis.Options{Addr: addr}),
+        fallback: NewLocal(),
+    }
+}
+
+func (r *Redis) Allow(ctx context.Context, key string, l Limit, cost int) Decision {
+    vals, err := takeScript.Run(ctx, r.client, []string{keyPrefix + key}, l.Rate, l.burst(), cost).Int64Slice()
+    if err != nil || len(vals) != 3 {
+        fallbackTotal.Inc()
+        if !r.failing.Swap(true) {
+            log.Printf("ratelimit: redis unavailable, limiting per instance: %v", err)
+        }
+        return r.fallback.Allow(ctx, key, l, cost)
+    }
+    if r.failing.Swap(false) {
+        log.Printf("ratelimit: redis available again")
+    }
+    return Decision{
+        Allowed:    vals[0] == 1,
+        Remaining:  int(vals[1]),
+        RetryAfter: time.Duration(vals[2]) * time.Microsecond,
+    }
+}
+
+func (r *Redis) Refund(ctx context.Context, key string, l Limit, cost int) {
+    if r.failing.Load() {
+        r.fallback.Refund(ctx, key, l, cost)
+        return
+    }
+    if err := refundScript.Run(ctx, r.client, []string{keyPrefix + key}, l.burst(), cost).Err(); err != nil {
+        log.Printf("ratelimit: refund error: %v", err)
+    }
+}
+
+func (r *Redis) Close() error {
+    return r.client.Close()
+}
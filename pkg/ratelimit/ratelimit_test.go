@@ -0,0 +1,119 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLocal_Allow(t *testing.T) {
+	now := time.Unix(1000, 0)
+	lc := NewLocal()
+	lc.now = func() time.Time { return now }
+	l := Limit{Rate: 2, Burst: 3}
+	ctx := context.Background()
+
+	tests := []struct {
+		name        string
+		advance     time.Duration
+		cost        int
+		wantAllowed bool
+		wantRetry   time.Duration
+	}{
+		{"burst 1", 0, 1, true, 0},
+		{"burst 2", 0, 1, true, 0},
+		{"burst 3", 0, 1, true, 0},
+		{"empty", 0, 1, false, 500 * time.Millisecond},
+		{"refilled one", 500 * time.Millisecond, 1, true, 0},
+		{"cost above tokens", time.Second, 3, false, 500 * time.Millisecond},
+		{"refill capped at burst", time.Hour, 3, true, 0},
+	}
+	for _, tt := range tests {
+		now = now.Add(tt.advance)
+		d := lc.Allow(ctx, "a", l, tt.cost)
+		if d.Allowed != tt.wantAllowed || d.RetryAfter != tt.wantRetry {
+			t.Errorf("%s: Allow() = %+v, want allowed %v retry %v", tt.name, d, tt.wantAllowed, tt.wantRetry)
+		}
+	}
+	if d := lc.Allow(ctx, "b", l, 1); !d.Allowed || d.Remaining != 2 {
+		t.Errorf("Allow(b) = %+v, want its own bucket", d)
+	}
+}
+
+func TestLocal_Sweep(t *testing.T) {
+	now := time.Unix(1000, 0)
+	lc := NewLocal()
+	lc.now = func() time.Time { return now }
+	l := Limit{Rate: 1, Burst: 1}
+	ctx := context.Background()
+	for i := 0; i < maxLocalBuckets; i++ {
+		lc.Allow(ctx, fmt.Sprint(i), l, 1)
+	}
+	now = now.Add(2 * time.Second)
+	lc.Allow(ctx, "new", l, 1)
+	if got := len(lc.buckets); got != 1 {
+		t.Errorf("buckets after sweep = %d, want 1", got)
+	}
+}
+
+func TestPolicy_Check(t *testing.T) {
+	ctx := context.Background()
+	backends := map[string]Limiter{"local": NewLocal()}
+	if r := NewRedis("localhost:6379"); r.client.Ping(ctx).Err() == nil {
+		backends["redis"] = r
+		defer r.Close()
+	}
+	for name, lim := range backends {
+		t.Run(name, func(t *testing.T) {
+			// unique names so reruns against a shared Redis start with full buckets
+			suffix := fmt.Sprint(time.Now().UnixNano())
+			p := &Policy{
+				Limiter: lim,
+				PerKey:  Limit{Rate: 0.001, Burst: 4},
+				PerUser: Limit{Rate: 0.001, Burst: 2},
+			}
+			key, alice, bob := "k"+suffix, "alice"+suffix, "bob"+suffix
+			for i := 0; i < 2; i++ {
+				if d := p.Check(ctx, key, alice, 1); !d.Allowed {
+					t.Fatalf("Check(alice) #%d = %+v, want allowed", i, d)
+				}
+			}
+			d := p.Check(ctx, key, alice, 1)
+			if d.Allowed || d.RetryAfter <= 0 {
+				t.Errorf("Check(alice) over user limit = %+v", d)
+			}
+			// bob has his own user bucket but shares the key's
+			if d := p.Check(ctx, key, bob, 1); !d.Allowed {
+				t.Errorf("Check(bob) = %+v, want allowed", d)
+			}
+			// alice's refused request was refunded to the key
+			if d := p.Check(ctx, key, "", 1); !d.Allowed {
+				t.Errorf("Check() with the refunded token = %+v, want allowed", d)
+			}
+			if d := p.Check(ctx, key, "", 1); d.Allowed {
+				t.Errorf("Check() over key limit = %+v, want limited", d)
+			}
+			// cost above burst is charged as the full burst
+			if d := p.Check(ctx, "", "carol"+suffix, 10); !d.Allowed {
+				t.Errorf("Check(carol, 10) = %+v, want allowed", d)
+			}
+			if d := p.Check(ctx, "", "", 100); !d.Allowed {
+				t.Errorf("Check() without caller and user = %+v, want allowed", d)
+			}
+		})
+	}
+}
+
+func TestRedis_Fallback(t *testing.T) {
+	r := NewRedis("localhost:1")
+	defer r.Close()
+	l := Limit{Rate: 0.001, Burst: 1}
+	ctx := context.Background()
+	if d := r.Allow(ctx, "a", l, 1); !d.Allowed {
+		t.Fatalf("Allow() = %+v, want allowed", d)
+	}
+	if d := r.Allow(ctx, "a", l, 1); d.Allowed {
+		t.Errorf("Allow() = %+v, want limited by the in-process bucket", d)
+	}
+}
@@ -0,0 +1,528 @@
+package wal
+
+import (
+    "bufio"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "hash/crc32"
+    "io"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Log is a segmented append-only write-ahead log. Every entry gets a
+// monotonically increasing sequence number starting at 1. Entries up to the
+// checkpoint passed to Truncate are considered applied and are skipped on
+// replay; whole segments below the checkpoint are deleted.
+//
+// On-disk entry layout: crc32c(seq|payload) uint32, len uint32, seq uint64,
+// payload. A torn tail left by a crash is cut off when the log is opened.
+type Log struct {
+    dir  string
+    opts Options
+
+    mu         sync.Mutex
+    segments   []uint64 // first seq of every segment, ascending; last is active
+    active     *os.File
+    activeSize int64
+    nextSeq    uint64
+    replayEnd  uint64 // entries below this were on disk when the log was opened
+    checkpoint uint64
+    dirty      bool
+    closed     bool
+    // broken is set when a failed append could not be rolled back; the
+    // segment then ends in garbage that would hide later entries
+    broken error
+
+    stop chan struct{}
+    done chan struct{}
+}
+
+type SyncPolicy int
+
+const (
+    // SyncAlways fsyncs after every append, so an acknowledged entry
+    // survives power loss.
+    SyncAlways SyncPolicy = iota
+    // SyncInterval fsyncs in the background every Options.SyncInterval.
+    SyncInterval
+    // SyncNever leaves flushing to the OS; entries survive a process crash
+    // but not a machine crash.
+    SyncNever
+)
+
+type Options struct {
+    SegmentSize  int64
+    Sync         SyncPolicy
+    SyncInterval time.Duration
+}
+
+const (
+    headerSize     = 16
+    // maxEntrySize bounds a payload, so that a corrupt length cannot make
+    // a reader allocate gigabytes.
+    maxEntrySize   = 64 << 20
+    segmentExt     = ".wal"
+    checkpointFile = "checkpoint"
+
+    defaultSegmentSize  = 64 << 20
+    defaultSyncInterval = 100 * time.Millisecond
+)
+
+var (
+    ErrClosed   = errors.New("wal: log closed")
+    ErrCorrupt  = errors.New("wal: corrupt segment")
+    ErrTooLarge = fmt.Errorf("wal: entry larger than %d bytes", maxEntrySize)
+
+    crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// ParseSyncPolicy maps "always", "interval" and "never" to a SyncPolicy.
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+    switch strings.ToLower(s) {
+    case "", "always":
+        return SyncAlways, nil
+    case "interval":
+        return SyncInterval, nil
+    case "never", "none":
+        return SyncNever, nil
+    }
+    return 0, fmt.Errorf("wal: unknown sync policy %q", s)
+}
+
+// Open opens or creates the log stored in dir.
+func Open(dir string, opts Options) (*Log, error) {
+    if opts.SegmentSize <= 0 {
+        opts.SegmentSize = defaultSegmentSize
+    }
+    if opts.SyncInterval <= 0 {
+        opts.SyncInterval = defaultSyncInterval
+    }
+    if err := os.MkdirAll(dir, 0o755); err != nil {
+        return nil, err
+    }
+    l := &Log{dir: dir, opts: opts}
+
+    cp, err := readCheckpoint(filepath.Join(dir, checkpointFile))
+    if err != nil {
+        return nil, err
+    }
+    l.checkpoint = cp
+
+    segs, err := listSegments(dir)
+    if err != nil {
+        return nil, err
+    }
+    l.segments = segs
+    l.nextSeq = cp + 1
+
+    if len(segs) > 0 {
+        last := segs[len(segs)-1]
+        path := l.segmentPath(last)
+        lastSeq, validSize, err := scanTail(path)
+        if err != nil {
+            return nil, err
+        }
+        if err := os.Truncate(path, validSize); err != nil {
+            return nil, err
+        }
+        if lastSeq >= l.nextSeq {
+            l.nextSeq = lastSeq + 1
+        }
+        if validSize == 0 && last != l.nextSeq {
+            // empty tail segment that does not start at nextSeq; replace it
+            if err := os.Remove(path); err != nil {
+                return nil, err
+            }
+            l.segments = l.segments[:len(l.segments)-1]
+        } else {
+            f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+            if err != nil {
+                return nil, err
+            }
+            l.active = f
+            l.activeSize = validSize
+        }
+    }
+    if l.active == nil {
+        if err := l.createSegment(); err != nil {
+            return nil, err
+        }
+    }
+    l.replayEnd = l.nextSeq
+
+    if opts.Sync == SyncInterval {
+        l.stop = make(chan struct{})
+        l.done = make(chan struct{})
+        go l.syncLoop()
+    }
+    return l, nil
+}
+
+// Append writes data as a new entry and returns its sequence number. With
+// SyncAlways the entry is on stable storage when Append returns.
+func (l *Log) Append(data []byte) (uint64, error) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if l.closed {
+        return 0, ErrClosed
+    }
+    if l.broken != nil {
+        return 0, l.broken
+    }
+    if len(data) > maxEntrySize {
+        return 0, ErrTooLarge
+    }
+    if l.activeSize > 0 && l.activeSize+int64(headerSize+len(data)) > l.opts.SegmentSize {
+        if err := l.rotate(); err != nil {
+            return 0, err
+        }
+    }
+    seq := l.nextSeq
+    buf := encode(seq, data)
+    if _, err := l.active.Write(buf); err != nil {
+        // cut off a partial entry, or replay would stop at it and drop
+        // every entry appended after it
+        l.rollback()
+        return 0, err
+    }
+    if l.opts.Sync == SyncAlways {
+        if err := l.active.Sync(); err != nil {
+            // the caller is told the entry was not logged, so it must not
+            // be replayed, and its seq is handed out again
+            l.rollback()
+            return 0, err
+        }
+    } else {
+        l.dirty = true
+    }
+    l.activeSize += int64(len(buf))
+    l.nextSeq++
+    return seq, nil
+}
+
+// rollback cuts the active segment back to activeSize after a failed
+// append, with l.mu held. If that fails too the log is marked broken.
+func (l *Log) rollback() {
+    if err := l.active.Truncate(l.activeSize); err != nil {
+        l.broken = fmt.Errorf("wal: append failed and could not be rolled back: %v", err)
+    }
+}
+
+// Replay calls fn for every entry that was on disk when the log was opened
+// and lies above the checkpoint, in sequence order.
+func (l *Log) Replay(fn func(seq uint64, data []byte) error) error {
+    l.mu.Lock()
+    from, to := l.checkpoint+1, l.replayEnd
+    l.mu.Unlock()
+    return l.scan(from, to, fn)
+}
+
+// Read calls fn for the entries with from <= seq < to, in sequence order.
+// The range must lie above the checkpoint. An error from fn stops the scan
+// and is returned.
+func (l *Log) Read(from, to uint64, fn func(seq uint64, data []byte) error) error {
+    return l.scan(from, to, fn)
+}
+
+// Truncate records that every entry up to and including seq has been applied
+// and removes segments that no longer hold live entries.
+func (l *Log) Truncate(seq uint64) error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if l.closed {
+        return ErrClosed
+    }
+    if seq <= l.checkpoint {
+        return nil
+    }
+    if seq >= l.nextSeq {
+        seq = l.nextSeq - 1
+    }
+    if err := writeCheckpoint(filepath.Join(l.dir, checkpointFile), seq); err != nil {
+        return err
+    }
+    l.checkpoint = seq
+
+    keep := l.segments[:0]
+    for i, first := range l.segments {
+        active := i == len(l.segments)-1
+        if !active && l.segments[i+1]-1 <= seq {
+            if err := os.Remove(l.segmentPath(first)); err != nil && !os.IsNotExist(err) {
+                return err
+            }
+            continue
+        }
+        keep = append(keep, first)
+    }
+    l.segments = keep
+    return nil
+}
+
+// Sync flushes buffered appends to stable storage.
+func (l *Log) Sync() error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    return l.syncLocked()
+}
+
+// Close syncs and closes the active segment.
+func (l *Log) Close() error {
+    l.mu.Lock()
+    if l.closed {
+        l.mu.Unlock()
+        return nil
+    }
+    l.closed = true
+    l.mu.Unlock()
+
+    if l.stop != nil {
+        close(l.stop)
+        <-l.done
+    }
+
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if err := l.active.Sync(); err != nil {
+        l.active.Close()
+        return err
+    }
+    return l.active.Close()
+}
+
+func (l *Log) syncLoop() {
+    defer close(l.done)
+    t := time.NewTicker(l.opts.SyncInterval)
+    defer t.Stop()
+    for {
+        select {
+        case <-l.stop:
+            return
+        case <-t.C:
+            l.mu.Lock()
+            _ = l.syncLocked()
+            l.mu.Unlock()
+        }
+    }
+}
+
+func (l *Log) syncLocked() error {
+    if l.closed || !l.dirty {
+        return nil
+    }
+    if err := l.active.Sync(); err != nil {
+        return err
+    }
+    l.dirty = false
+    return nil
+}
+
+func (l *Log) rotate() error {
+    if err := l.active.Sync(); err != nil {
+        return err
+    }
+    if err := l.active.Close(); err != nil {
+        return err
+    }
+    l.dirty = false
+    return l.createSegment()
+}
+
+func (l *Log) createSegment() error {
+    f, err := os.OpenFile(l.segmentPath(l.nextSeq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+    if err != nil {
+        return err
+    }
+    // make the new file's directory entry durable
+    if err := syncDir(l.dir); err != nil {
+        f.Close()
+        return err
+    }
+    l.active = f
+    l.activeSize = 0
+    l.segments = append(l.segments, l.nextSeq)
+    return nil
+}
+
+// scan reads entries with from <= seq < to.
+func (l *Log) scan(from, to uint64, fn func(seq uint64, data []byte) error) error {
+    l.mu.Lock()
+    segs := append([]uint64(nil), l.segments...)
+    l.mu.Unlock()
+
+    for i, first := range segs {
+        if first >= to {
+            break
+        }
+        if i+1 < len(segs) && segs[i+1] <= from {
+            continue
+        }
+        last := i == len(segs)-1
+        if err := l.scanSegment(first, from, to, last, fn); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (l *Log) scanSegment(first, from, to uint64, last bool, fn func(uint64, []byte) error) error {
+    f, err := os.Open(l.segmentPath(first))
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    r := bufio.NewReader(f)
+    for {
+        seq, data, err := readEntry(r)
+        if err == io.EOF {
+            return nil
+        }
+        if err != nil {
+            if last {
+                // torn write racing with an append on the active segment
+                return nil
+            }
+            return fmt.Errorf("%w %s: %v", ErrCorrupt, l.segmentPath(first), err)
+        }
+        if seq >= to {
+            return nil
+        }
+        if seq < from {
+            continue
+        }
+        if err := fn(seq, data); err != nil {
+            return err
+        }
+    }
+}
+
+func (l *Log) segmentPath(first uint64) string {
+    return filepath.Join(l.dir, fmt.Sprintf("%020d%s", first, segmentExt))
+}
+
+func encode(seq uint64, data []byte) []byte {
+    buf := make([]byte, headerSize+len(data))
+    binary.BigEndian.PutUint32(buf[4:8], uint32(len(data)))
+    binary.BigEndian.PutUint64(buf[8:16], seq)
+    copy(buf[headerSize:], data)
+    binary.BigEndian.PutUint32(buf[0:4], crc32.Checksum(buf[8:], crcTable))
+    return buf
+}
+
+func readEntry(r io.Reader) (uint64, []byte, error) {
+    var hdr [headerSize]byte
+    if _, err := io.ReadFull(r, hdr[:]); err != nil {
+        return 0, nil, err
+    }
+    sum := binary.BigEndian.Uint32(hdr[0:4])
+    n := binary.BigEndian.Uint32(hdr[4:8])
+    seq := binary.BigEndian.Uint64(hdr[8:16])
+    if n > maxEntrySize {
+        return 0, nil, fmt.Errorf("entry length %d exceeds %d", n, maxEntrySize)
+    }
+    data := make([]byte, n)
+    if _, err := io.ReadFull(r, data); err != nil {
+        if err == io.EOF {
+            err = io.ErrUnexpectedEOF
+        }
+        return 0, nil, err
+    }
+    crc := crc32.Update(crc32.Checksum(hdr[8:16], crcTable), crcTable, data)
+    if crc != sum {
+        return 0, nil, errors.New("checksum mismatch")
+    }
+    return seq, data, nil
+}
+
+// scanTail returns the last intact seq in a segment and the byte offset just
+// past it.
+func scanTail(path string) (uint64, int64, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return 0, 0, err
+    }
+    defer f.Close()
+    r := bufio.NewReader(f)
+    var lastSeq uint64
+    var size int64
+    for {
+        seq, data, err := readEntry(r)
+        if err != nil {
+            return lastSeq, size, nil
+        }
+        lastSeq = seq
+        size += int64(headerSize + len(data))
+    }
+}
+
+func listSegments(dir string) ([]uint64, error) {
+    entries, err := os.ReadDir(dir)
+    if err != nil {
+        return nil, err
+    }
+    var segs []uint64
+    for _, e := range entries {
+        name := e.Name()
+        if e.IsDir() || !strings.HasSuffix(name, segmentExt) {
+            continue
+        }
+        first, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+        if err != nil {
+            continue
+        }
+        segs = append(segs, first)
+    }
+    sort.Slice(segs, func(i, j int) bool { return segs[i] < segs[j] })
+    return segs, nil
+}
+
+func readCheckpoint(path string) (uint64, error) {
+    b, err := os.ReadFile(path)
+    if os.IsNotExist(err) {
+        return 0, nil
+    }
+    if err != nil {
+        return 0, err
+    }
+    return strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+}
+
+func writeCheckpoint(path string, seq uint64) error {
+    tmp := path + ".tmp"
+    f, err := os.Create(tmp)
+    if err != nil {
+        return err
+    }
+    if _, err := f.WriteString(strconv.FormatUint(seq, 10)); err != nil {
+        f.Close()
+        return err
+    }
+    if err := f.Sync(); err != nil {
+        f.Close()
+        return err
+    }
+    if err := f.Close(); err != nil {
+        return err
+    }
+    if err := os.Rename(tmp, path); err != nil {
+        return err
+    }
+    return syncDir(filepath.Dir(path))
+}
+
+// syncDir fsyncs a directory so that files created or renamed in it survive
+// power loss.
+func syncDir(dir string) error {
+    d, err := os.Open(dir)
+    if err != nil {
+        return err
+    }
+    defer d.Close()
+    return d.Sync()
+}
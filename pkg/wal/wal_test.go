@@ -0,0 +1,263 @@
+package wal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func collect(t *testing.T, l *Log) []string {
+	t.Helper()
+	var got []string
+	err := l.Replay(func(seq uint64, data []byte) error {
+		got = append(got, fmt.Sprintf("%d:%s", seq, data))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Replay() error = %v", err)
+	}
+	return got
+}
+
+func TestLog_AppendReplay(t *testing.T) {
+	tests := []struct {
+		name        string
+		segmentSize int64
+		sync        SyncPolicy
+	}{
+		{"single segment", 0, SyncAlways},
+		{"many segments", 64, SyncAlways},
+		{"interval sync", 64, SyncInterval},
+		{"never sync", 0, SyncNever},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			l, err := Open(dir, Options{SegmentSize: tt.segmentSize, Sync: tt.sync})
+			if err != nil {
+				t.Fatalf("Open() error = %v", err)
+			}
+			for i := 1; i <= 10; i++ {
+				seq, err := l.Append([]byte(fmt.Sprintf("v%d", i)))
+				if err != nil {
+					t.Fatalf("Append() error = %v", err)
+				}
+				if seq != uint64(i) {
+					t.Errorf("Append() seq = %d, want %d", seq, i)
+				}
+			}
+			// entries appended in this process are not replayed
+			if got := collect(t, l); len(got) != 0 {
+				t.Errorf("Replay() on fresh log = %v, want none", got)
+			}
+			if err := l.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+
+			l, err = Open(dir, Options{SegmentSize: tt.segmentSize, Sync: tt.sync})
+			if err != nil {
+				t.Fatalf("reopen error = %v", err)
+			}
+			defer l.Close()
+			got := collect(t, l)
+			if len(got) != 10 || got[0] != "1:v1" || got[9] != "10:v10" {
+				t.Errorf("Replay() = %v", got)
+			}
+			seq, err := l.Append([]byte("next"))
+			if err != nil {
+				t.Fatalf("Append() after reopen error = %v", err)
+			}
+			if seq != 11 {
+				t.Errorf("Append() after reopen seq = %d, want 11", seq)
+			}
+		})
+	}
+}
+
+func TestLog_Truncate(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, Options{SegmentSize: 64})
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	for i := 1; i <= 20; i++ {
+		if _, err := l.Append([]byte(fmt.Sprintf("v%d", i))); err != nil {
+			t.Fatalf("Append() error = %v", err)
+		}
+	}
+	before, _ := filepath.Glob(filepath.Join(dir, "*.wal"))
+	if err := l.Truncate(15); err != nil {
+		t.Fatalf("Truncate() error = %v", err)
+	}
+	after, _ := filepath.Glob(filepath.Join(dir, "*.wal"))
+	if len(after) >= len(before) {
+		t.Errorf("Truncate() kept %d of %d segments", len(after), len(before))
+	}
+	l.Close()
+
+	l, err = Open(dir, Options{SegmentSize: 64})
+	if err != nil {
+		t.Fatalf("reopen error = %v", err)
+	}
+	got := collect(t, l)
+	want := []string{"16:v16", "17:v17", "18:v18", "19:v19", "20:v20"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Replay() after Truncate = %v, want %v", got, want)
+	}
+
+	// truncating everything still keeps numbering monotonic
+	if err := l.Truncate(20); err != nil {
+		t.Fatalf("Truncate() error = %v", err)
+	}
+	l.Close()
+	l, err = Open(dir, Options{SegmentSize: 64})
+	if err != nil {
+		t.Fatalf("reopen error = %v", err)
+	}
+	defer l.Close()
+	if got := collect(t, l); len(got) != 0 {
+		t.Errorf("Replay() after full Truncate = %v, want none", got)
+	}
+	if seq, _ := l.Append([]byte("x")); seq != 21 {
+		t.Errorf("Append() seq = %d, want 21", seq)
+	}
+}
+
+func TestLog_Read(t *testing.T) {
+	l, err := Open(t.TempDir(), Options{SegmentSize: 64})
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer l.Close()
+	for i := 1; i <= 10; i++ {
+		if _, err := l.Append([]byte(fmt.Sprintf("v%d", i))); err != nil {
+			t.Fatalf("Append() error = %v", err)
+		}
+	}
+	if err := l.Truncate(2); err != nil {
+		t.Fatalf("Truncate() error = %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		from, to uint64
+		stopAt   uint64
+		want     string
+	}{
+		{"middle", 4, 7, 0, "[4:v4 5:v5 6:v6]"},
+		{"to the end", 9, 100, 0, "[9:v9 10:v10]"},
+		{"stopped", 3, 11, 5, "[3:v3 4:v4]"},
+		{"empty", 5, 5, 0, "[]"},
+	}
+	stop := fmt.Errorf("stop")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			err := l.Read(tt.from, tt.to, func(seq uint64, data []byte) error {
+				if seq == tt.stopAt {
+					return stop
+				}
+				got = append(got, fmt.Sprintf("%d:%s", seq, data))
+				return nil
+			})
+			if (err == stop) != (tt.stopAt != 0) || (err != nil && err != stop) {
+				t.Fatalf("Read() error = %v", err)
+			}
+			if fmt.Sprint(got) != tt.want {
+				t.Errorf("Read() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLog_TornTail(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	for i := 1; i <= 3; i++ {
+		l.Append([]byte(fmt.Sprintf("v%d", i)))
+	}
+	l.Close()
+
+	segs, _ := filepath.Glob(filepath.Join(dir, "*.wal"))
+	if len(segs) != 1 {
+		t.Fatalf("expected 1 segment, got %d", len(segs))
+	}
+	// simulate a crash halfway through writing a fourth entry
+	f, _ := os.OpenFile(segs[0], os.O_WRONLY|os.O_APPEND, 0o644)
+	f.Write(encode(4, []byte("v4"))[:10])
+	f.Close()
+
+	l, err = Open(dir, Options{})
+	if err != nil {
+		t.Fatalf("reopen error = %v", err)
+	}
+	defer l.Close()
+	got := collect(t, l)
+	if len(got) != 3 {
+		t.Errorf("Replay() = %v, want 3 intact entries", got)
+	}
+	if seq, _ := l.Append([]byte("v4")); seq != 4 {
+		t.Errorf("Append() seq = %d, want 4", seq)
+	}
+}
+
+func TestLog_CorruptLength(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	l.Append([]byte("v1"))
+	if _, err := l.Append(make([]byte, maxEntrySize+1)); err != ErrTooLarge {
+		t.Errorf("Append(oversized) error = %v, want ErrTooLarge", err)
+	}
+	l.Close()
+
+	// a header claiming a 4 GiB payload must not be allocated
+	segs, _ := filepath.Glob(filepath.Join(dir, "*.wal"))
+	hdr := encode(2, nil)
+	hdr[4], hdr[5], hdr[6], hdr[7] = 0xff, 0xff, 0xff, 0xff
+	f, _ := os.OpenFile(segs[0], os.O_WRONLY|os.O_APPEND, 0o644)
+	f.Write(hdr)
+	f.Close()
+
+	l, err = Open(dir, Options{})
+	if err != nil {
+		t.Fatalf("reopen error = %v", err)
+	}
+	defer l.Close()
+	if got := collect(t, l); len(got) != 1 || got[0] != "1:v1" {
+		t.Errorf("Replay() = %v, want [1:v1]", got)
+	}
+}
+
+func TestParseSyncPolicy(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    SyncPolicy
+		wantErr bool
+	}{
+		{"", SyncAlways, false},
+		{"always", SyncAlways, false},
+		{"interval", SyncInterval, false},
+		{"never", SyncNever, false},
+		{"sometimes", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseSyncPolicy(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseSyncPolicy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseSyncPolicy() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
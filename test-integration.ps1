@@ -1,5 +1,5 @@
 # Integration Test Suite for dsProxy
-# Run this script after starting the application with: go run cmd/dsproxy/main.go
+# Run this script after starting the application with: go run ./cmd/dsproxy
 # Make sure PostgreSQL and Redis containers are running
 
 Write-Host "`n========================================" -ForegroundColor Magenta